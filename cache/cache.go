@@ -2,35 +2,77 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-redis/redis/extra/redisotel/v8"
 	"github.com/go-redis/redis/v8"
 	"miikka.xyz/devops-app/lib/repo"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
 	"miikka.xyz/devops-app/utils"
 )
 
+// redisKeyTraffic is a prefix, each precomputed window has own key like 'traffic:7d'
 const redisKeyTraffic = "traffic"
 
-// Cache is wrapper for a redis client
+// channelTrafficUpdated gets a message whenever any instance has rebuilt traffic cache
+const channelTrafficUpdated = "traffic:updated"
+
+// Cache is wrapper for a redis client. Client is single node, sentinel or
+// cluster client depending on configuration.
 type Cache struct {
-	*redis.Client
+	redis.UniversalClient
+	// Codec is used when writing values. Reading works with any codec.
+	Codec Codec
+	// Windows are traffic ranges that will be precomputed to cache, like "7d"
+	Windows []string
+	// DefaultWindow is used when range is not requested
+	DefaultWindow string
+	stats         PayloadStats
+}
+
+// PayloadStats holds size metrics of the values written to cache
+type PayloadStats struct {
+	Writes            int64
+	LastRawBytes      int64
+	LastEncodedBytes  int64
+	TotalEncodedBytes int64
 }
 
-// New returns a new redis client
+// New returns a new redis client configured from environment variables
 func New(isTest bool) (*Cache, func(ctx context.Context)) {
-	db := 0
-	if isTest {
-		db = 3
+	cfg, err := ConfigFromEnv(isTest)
+	if err != nil {
+		logger.Fatal("invalid redis config", logger.FieldError, err)
+	}
+	client, err := newClient(cfg)
+	if err != nil {
+		logger.Fatal("invalid redis config", logger.FieldError, err)
+	}
+	client.AddHook(redisotel.NewTracingHook())
+	logger.Info("redis client created", "mode", cfg.Mode)
+
+	codec, err := CodecByName(utils.GetEnv("CACHE_CODEC", "json"))
+	if err != nil {
+		logger.Warn("invalid cache codec, using json", logger.FieldError, err)
+		codec = jsonCodec{}
 	}
 
 	cache := &Cache{
-		redis.NewClient(&redis.Options{
-			Addr:     utils.GetEnv("REDIS_URL", "localhost:6379"),
-			Password: "",
-			DB:       db,
-		}),
+		UniversalClient: client,
+		Codec:           codec,
+		DefaultWindow:   utils.GetEnv("TRAFFIC_DEFAULT_WINDOW", "7d"),
+		Windows:         parseWindows(utils.GetEnv("TRAFFIC_WINDOWS", "7d,30d,90d")),
+	}
+	if _, err := repo.NamedRange(cache.DefaultWindow, time.Now()); err != nil {
+		logger.Warn("invalid default window, using 7d", logger.FieldError, err)
+		cache.DefaultWindow = "7d"
+	}
+	if !cache.isPrecomputed(cache.DefaultWindow) {
+		cache.Windows = append(cache.Windows, cache.DefaultWindow)
 	}
 
 	teardown := func(ctx context.Context) {
@@ -40,49 +82,128 @@ func New(isTest bool) (*Cache, func(ctx context.Context)) {
 	return cache, teardown
 }
 
-// UpdateTrafficCache gets traffic data from database starting from day 'daysAgo'
-// and puts that data to cache. Default 'daysAgo' is 8
-func (c *Cache) UpdateTrafficCache(ctx context.Context, daysAgo int) error {
-	log.Println("updating cache...")
+// UpdateTrafficCache gets traffic data of every precomputed window from database
+// and puts that data to cache
+func (c *Cache) UpdateTrafficCache(ctx context.Context) error {
+	logger.FromContext(ctx).Info("updating cache")
 
-	// Default is one week. -8 days because GitHub API doesn't return data for current day (not sure though)
-	if daysAgo == 0 {
-		daysAgo = -8
-	} else if daysAgo >= 0 {
-		daysAgo = -daysAgo
+	// Query longest window once, shorter ones are filtered from it
+	now := time.Now()
+	ranges := make([]repo.TrafficRange, 0, len(c.Windows))
+	longest := repo.TrafficRange{From: now, To: now}
+	for _, name := range c.Windows {
+		r, err := repo.NamedRange(name, now)
+		if err != nil {
+			return err
+		}
+		if r.From.Before(longest.From) {
+			longest.From = r.From
+		}
+		ranges = append(ranges, r)
 	}
 
 	// Get traffic data from database
-	repos, err := repo.StoreGetRepositoryTrafficWithMeta(ctx, time.Now().AddDate(0, 0, daysAgo))
+	repos, err := repo.StoreGetRepositoryTrafficWithMeta(ctx, longest.From, longest.To)
 	if err != nil {
 		return err
 	}
+	all := repo.FormatRepositorysToMap(repos)
 
-	// Clear old data from cache
-	status := c.FlushDB(ctx)
-	if status.Err() != nil {
-		return err
+	// Format that data and update cache. Old keys are overwritten
+	for _, r := range ranges {
+		if err := c.setEncoded(ctx, trafficKey(r.Name), all.FilterByRange(r)); err != nil {
+			logger.FromContext(ctx).Error("updating traffic cache failed", "window", r.Name, logger.FieldError, err)
+			return err
+		}
 	}
 
-	// Format that data and update cache
-	if err := c.updateTrafficData(ctx, repo.FormatRepositorysToMap(repos)); err != nil {
-		log.Println("updating traffic cache failed", err)
-		return err
+	// Live dashboards read the new data, rebuild has succeeded even if they don't
+	if err := c.Publish(ctx, channelTrafficUpdated, now.Unix()).Err(); err != nil {
+		logger.FromContext(ctx).Warn("publishing cache update failed", logger.FieldError, err)
 	}
 
-	log.Println("cache updated!")
+	logger.FromContext(ctx).Info("cache updated")
 	return nil
 }
 
-// GetTrafficData returns traffic data from cache
-func (c *Cache) GetTrafficData(ctx context.Context) (repo.ReposByNameMap, error) {
-	cacheData, err := c.Get(ctx, redisKeyTraffic).Result()
+// TrafficUpdates returns a channel that gets a value after traffic cache has been
+// rebuilt by any instance. Updates that come while the previous one is unread are
+// merged. Channel is closed when ctx is done.
+func (c *Cache) TrafficUpdates(ctx context.Context) <-chan struct{} {
+	pubsub := c.Subscribe(ctx, channelTrafficUpdated)
+	updates := make(chan struct{}, 1)
+	go func() {
+		defer close(updates)
+		defer pubsub.Close()
+		msgs := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case updates <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return updates
+}
+
+// IsWarm reports whether traffic data of default window has been put to cache
+func (c *Cache) IsWarm(ctx context.Context) (bool, error) {
+	n, err := c.Exists(ctx, trafficKey(c.DefaultWindow)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// WarmUp fills cache from database unless some other instance has already done it
+func (c *Cache) WarmUp(ctx context.Context) error {
+	warm, err := c.IsWarm(ctx)
+	if err != nil {
+		return err
+	}
+	if warm {
+		logger.FromContext(ctx).Info("cache is already warm")
+		return nil
+	}
+	return c.UpdateTrafficCache(ctx)
+}
+
+// GetTrafficData returns traffic data of the range. Precomputed windows are served from
+// cache, other ranges and cache misses are computed from database on demand.
+func (c *Cache) GetTrafficData(ctx context.Context, trafficRange repo.TrafficRange) (repo.ReposByNameMap, error) {
+	if !trafficRange.IsCustom() && c.isPrecomputed(trafficRange.Name) {
+		trafficByRepoName, err := c.getTrafficData(ctx, trafficRange.Name)
+		if err == nil {
+			metrics.CacheRequests.WithLabelValues(trafficRange.Name, "hit").Inc()
+			return trafficByRepoName, nil
+		}
+		metrics.CacheRequests.WithLabelValues(trafficRange.Name, "miss").Inc()
+		logger.FromContext(ctx).Warn("could not find data from cache", "window", trafficRange.Name, logger.FieldError, err)
+	}
+
+	repos, err := repo.StoreGetRepositoryTrafficWithMeta(ctx, trafficRange.From, trafficRange.To)
+	if err != nil {
+		return nil, err
+	}
+	return repo.FormatRepositorysToMap(repos), nil
+}
+
+func (c *Cache) getTrafficData(ctx context.Context, window string) (repo.ReposByNameMap, error) {
+	cacheData, err := c.Get(ctx, trafficKey(window)).Result()
 	if err != nil {
 		return nil, err
 	}
 
 	var trafficByRepoName repo.ReposByNameMap
-	err = json.Unmarshal([]byte(cacheData), &trafficByRepoName)
+	err = Decode([]byte(cacheData), &trafficByRepoName)
 	if err != nil {
 		return nil, err
 	}
@@ -90,10 +211,67 @@ func (c *Cache) GetTrafficData(ctx context.Context) (repo.ReposByNameMap, error)
 	return trafficByRepoName, nil
 }
 
-func (c *Cache) updateTrafficData(ctx context.Context, trafficByRepoName repo.ReposByNameMap) error {
-	err := c.Set(ctx, redisKeyTraffic, trafficByRepoName, 0).Err()
+// Stats returns size metrics of written payloads
+func (c *Cache) Stats() PayloadStats {
+	return PayloadStats{
+		Writes:            atomic.LoadInt64(&c.stats.Writes),
+		LastRawBytes:      atomic.LoadInt64(&c.stats.LastRawBytes),
+		LastEncodedBytes:  atomic.LoadInt64(&c.stats.LastEncodedBytes),
+		TotalEncodedBytes: atomic.LoadInt64(&c.stats.TotalEncodedBytes),
+	}
+}
+
+// setEncoded encodes value with cache's codec, saves it and records payload size
+func (c *Cache) setEncoded(ctx context.Context, key string, value interface{}) error {
+	data, err := Encode(c.Codec, value)
 	if err != nil {
 		return err
 	}
+	if err := c.Set(ctx, key, data, 0).Err(); err != nil {
+		return err
+	}
+
+	// Raw size is what plain JSON would have been
+	rawSize := len(data) - 1
+	if c.Codec.Header() != headerJSON {
+		raw, err := jsonCodec{}.Encode(value)
+		if err != nil {
+			return err
+		}
+		rawSize = len(raw)
+	}
+	atomic.AddInt64(&c.stats.Writes, 1)
+	atomic.StoreInt64(&c.stats.LastRawBytes, int64(rawSize))
+	atomic.StoreInt64(&c.stats.LastEncodedBytes, int64(len(data)))
+	atomic.AddInt64(&c.stats.TotalEncodedBytes, int64(len(data)))
+	metrics.CachePayloadBytes.WithLabelValues(key, c.Codec.Name()).Set(float64(len(data)))
+	logger.FromContext(ctx).Debug("cache write", "key", key, "codec", c.Codec.Name(), "raw_bytes", rawSize, "encoded_bytes", len(data))
 	return nil
 }
+
+func (c *Cache) isPrecomputed(window string) bool {
+	for _, w := range c.Windows {
+		if w == window {
+			return true
+		}
+	}
+	return false
+}
+
+func trafficKey(window string) string {
+	return fmt.Sprintf("%s:%s", redisKeyTraffic, window)
+}
+
+// parseWindows parses comma separated windows and skips invalid ones
+func parseWindows(value string) []string {
+	windows := make([]string, 0)
+	for _, w := range strings.Split(value, ",") {
+		w = strings.TrimSpace(w)
+		if _, err := repo.NamedRange(w, time.Now()); err != nil {
+			logger.Warn("skipping traffic window", logger.FieldError, err)
+			continue
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
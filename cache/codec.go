@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Header bytes. Every value written to cache starts with one of these so
+// readers can decode values written by any codec version.
+const (
+	headerJSON     byte = 0x01
+	headerGzipJSON byte = 0x02
+	headerZstdJSON byte = 0x03
+	headerMsgpack  byte = 0x04
+)
+
+// Codec encodes and decodes cache values
+type Codec interface {
+	// Name is used when selecting codec with CACHE_CODEC env
+	Name() string
+	// Header is the first byte of every encoded value
+	Header() byte
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var codecs = map[byte]Codec{
+	headerJSON:     jsonCodec{},
+	headerGzipJSON: gzipJSONCodec{},
+	headerZstdJSON: zstdJSONCodec{},
+	headerMsgpack:  msgpackCodec{},
+}
+
+// CodecByName returns codec by its name: json, gzip, zstd or msgpack
+func CodecByName(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == strings.ToLower(strings.TrimSpace(name)) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cache codec '%s'", name)
+}
+
+// Encode encodes v with codec and prepends codec's header byte
+func Encode(codec Codec, v interface{}) ([]byte, error) {
+	payload, err := codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Header()}, payload...), nil
+}
+
+// Decode reads header byte and decodes rest of the data with matching codec.
+// Values written before codecs existed are plain JSON and have no header.
+func Decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("empty cache value")
+	}
+	if data[0] == '{' || data[0] == '[' {
+		return json.Unmarshal(data, v)
+	}
+	codec, found := codecs[data[0]]
+	if !found {
+		return fmt.Errorf("unknown cache header 0x%02x", data[0])
+	}
+	return codec.Decode(data[1:], v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Header() byte { return headerJSON }
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gzipJSONCodec struct{}
+
+func (gzipJSONCodec) Name() string { return "gzip" }
+func (gzipJSONCodec) Header() byte { return headerGzipJSON }
+
+func (gzipJSONCodec) Encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipJSONCodec) Decode(data []byte, v interface{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+type zstdJSONCodec struct{}
+
+func (zstdJSONCodec) Name() string { return "zstd" }
+func (zstdJSONCodec) Header() byte { return headerZstdJSON }
+
+func (zstdJSONCodec) Encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	return w.EncodeAll(data, nil), nil
+}
+
+func (zstdJSONCodec) Decode(data []byte, v interface{}) error {
+	r, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	raw, err := r.DecodeAll(data, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Header() byte { return headerMsgpack }
+
+// Encode uses json tags so field names match the JSON codecs
+func (msgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
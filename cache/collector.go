@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"miikka.xyz/devops-app/lib/repo"
+	"miikka.xyz/devops-app/logger"
+)
+
+var (
+	repoViewsDesc = prometheus.NewDesc("devops_app_repo_traffic_views",
+		"Views of a repository in precomputed window", []string{"repo", "window"}, nil)
+	repoUniqueViewsDesc = prometheus.NewDesc("devops_app_repo_traffic_unique_views",
+		"Unique views of a repository in precomputed window", []string{"repo", "window"}, nil)
+	repoClonesDesc = prometheus.NewDesc("devops_app_repo_traffic_clones",
+		"Clones of a repository in precomputed window", []string{"repo", "window"}, nil)
+)
+
+// TrafficCollector exports per repository traffic gauges. Values are read from cache
+// on every scrape, so all replicas report the same numbers.
+type TrafficCollector struct {
+	cache *Cache
+}
+
+// NewTrafficCollector returns collector that should be registered once
+func NewTrafficCollector(c *Cache) *TrafficCollector {
+	return &TrafficCollector{cache: c}
+}
+
+// Describe implements prometheus.Collector
+func (t *TrafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- repoViewsDesc
+	ch <- repoUniqueViewsDesc
+	ch <- repoClonesDesc
+}
+
+// Collect implements prometheus.Collector
+func (t *TrafficCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, window := range t.cache.Windows {
+		traffic, err := t.cache.getTrafficData(ctx, window)
+		if err != nil {
+			logger.Warn("collecting traffic metrics failed", "window", window, logger.FieldError, err)
+			continue
+		}
+		for name, series := range traffic {
+			totals := repo.Sum(series)
+			ch <- prometheus.MustNewConstMetric(repoViewsDesc, prometheus.GaugeValue, float64(totals.Views), name, window)
+			ch <- prometheus.MustNewConstMetric(repoUniqueViewsDesc, prometheus.GaugeValue, float64(totals.UniqueViews), name, window)
+			ch <- prometheus.MustNewConstMetric(repoClonesDesc, prometheus.GaugeValue, float64(totals.Clones), name, window)
+		}
+	}
+}
@@ -2,21 +2,39 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/streadway/amqp"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"miikka.xyz/devops-app/cache"
 	"miikka.xyz/devops-app/consts"
 	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/jobs"
 	"miikka.xyz/devops-app/jobs/github_traffic"
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
 	"miikka.xyz/devops-app/server"
 	"miikka.xyz/devops-app/store"
+	"miikka.xyz/devops-app/tracing"
 	"miikka.xyz/devops-app/utils"
 )
 
 func main() {
+	shutdownTracing, err := tracing.Init(context.Background(), consts.ServiceAPI)
+	if err != nil {
+		logger.Fatal("initializing tracing failed", logger.FieldError, err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Metrics are served on own port that is not exposed publicly
+	metrics.Listen(utils.GetEnv("METRICS_PORT", "9100"))
+
 	// Init RabbitMQ
 	rabbitConn, rabbitCh := events.CreateQueue(consts.QueueEventsName)
 	defer rabbitCh.Close()
@@ -25,48 +43,139 @@ func main() {
 	// TODO: Now store has init() function, which will be called automatically. Refactor that
 	defer store.Close()
 
+	// Unique indexes keep concurrent inserts from creating duplicates
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), time.Second*30)
+	if err := store.EnsureIndexes(indexCtx); err != nil {
+		logger.Error("creating indexes failed", logger.FieldError, err)
+	}
+	cancelIndexes()
+
 	cacheClient, _ := cache.New(false)
+	defer cacheClient.Close()
+	prometheus.MustRegister(cache.NewTrafficCollector(cacheClient))
 
 	// Create server and pass event queue for it
 	s := server.New("8080", rabbitCh, cacheClient)
+	addReadinessChecks(s, rabbitConn, cacheClient)
+
+	// Every replica has own queue of stored events for live streams
+	streamConn, streamCh, storedEvents := events.SubscribeStored()
+	defer streamCh.Close()
+	defer streamConn.Close()
+	go func() {
+		s.ConsumeStoredEvents(storedEvents)
+		logger.Warn("stored events queue was closed")
+	}()
 
+	// Fill cache in background so first visitors won't get an empty page
+	go warmUpCache(cacheClient)
+
+	// Live dashboards follow cache rebuilds of every instance
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go s.WatchTraffic(watchCtx)
+
+	// Jobs are waited on shutdown so those won't be stopped in the middle of saving
+	var jobsWG sync.WaitGroup
 	if utils.GetEnv("RUN_JOBS_ON_STARTUP", "false") == "true" {
-		log.Println("run jobs on startup is on")
+		logger.Info("run jobs on startup is on")
+		jobsWG.Add(1)
 		go func() {
+			defer jobsWG.Done()
 			runJobs(rabbitCh, cacheClient)
 		}()
 	} else {
-		log.Println("run jobs on startup is off")
+		logger.Info("run jobs on startup is off")
 	}
 
-	log.Println("Server listening 8080...")
-	if err := s.HTTP.ListenAndServe(); err != nil {
-		log.Fatal(err)
-	}
-}
+	// Kubernetes sends SIGTERM on rollouts, Ctrl+C sends SIGINT
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-func runJobs(rabbitCh *amqp.Channel, cacheClient *cache.Cache) {
-	if err := github_traffic.DoGithubTrafficStats(); err != nil {
-		log.Println("job failed", err)
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("server listening", "port", "8080")
+		serverErr <- s.HTTP.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server failed", logger.FieldError, err)
+		}
 		return
+	case <-signalCtx.Done():
+		// Second signal kills the process right away
+		stop()
 	}
-	event := events.Event{
-		CreatedAt: time.Now(),
-		ObjectID:  primitive.NilObjectID,
-		Type:      consts.EventTrafficJobCompleted,
+
+	timeout := utils.GetEnvDuration("SHUTDOWN_TIMEOUT", time.Second*25)
+	logger.Info("shutting down", "timeout", timeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("draining connections failed", logger.FieldError, err)
 	}
-	if err := events.Publish(rabbitCh, &event); err != nil {
-		log.Println("publishing event failed", err)
-		return
+	if !waitGroup(ctx, &jobsWG) {
+		logger.Warn("jobs did not finish before timeout")
 	}
-	log.Println("traffic data saved to database")
+	// Deferred functions close cache, database, queue and flush traces
+	logger.Info("server stopped")
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
+// waitGroup waits until wg is done or ctx expires. Reports whether wg got done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	// Update cache
-	err := cacheClient.UpdateTrafficCache(ctx, 0)
-	if err != nil {
-		log.Fatal(err)
+func addReadinessChecks(s *server.Server, rabbitConn *amqp.Connection, cacheClient *cache.Cache) {
+	s.AddReadinessCheck("mongo", store.Ping)
+	s.AddReadinessCheck("redis", cacheClient.HealthCheck)
+	s.AddReadinessCheck("rabbitmq", func(ctx context.Context) error {
+		if rabbitConn.IsClosed() {
+			return errors.New("connection closed")
+		}
+		return nil
+	})
+	s.AddReadinessCheck("cache", func(ctx context.Context) error {
+		warm, err := cacheClient.IsWarm(ctx)
+		if err != nil {
+			return err
+		}
+		if !warm {
+			return errors.New("cache is not warm")
+		}
+		return nil
+	})
+}
+
+// warmUpCache tries to fill cache from database until it succeeds
+func warmUpCache(cacheClient *cache.Cache) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err := cacheClient.WarmUp(ctx)
+		cancel()
+		if err == nil {
+			logger.Info("cache warm-up done")
+			return
+		}
+		logger.Warn("cache warm-up failed", "attempt", attempt, logger.FieldError, err)
+		time.Sleep(time.Second * 5)
 	}
 }
+
+func runJobs(rabbitCh *amqp.Channel, cacheClient *cache.Cache) {
+	runner := &jobs.Runner{Channel: rabbitCh}
+	runner.Run(context.Background(), &github_traffic.Job{Cache: cacheClient}, jobs.OptionsFromEnv(job.TriggerStartup))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"miikka.xyz/devops-app/lib/repo"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/store"
+)
+
+const usage = `Usage: cli <command> [flags]
+
+Commands:
+  export    Export traffic data as CSV or NDJSON
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// TODO: Refactor init() in store
+	defer store.Close()
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Error("command failed", logger.FieldError, err)
+		store.Close()
+		os.Exit(1)
+	}
+}
+
+// runExport streams traffic rows from database to file or stdout
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", repo.ExportCSV, "csv or ndjson")
+	trafficRange := flags.String("range", "", "range like 7d, 30d, 90d or custom (default 7d)")
+	from := flags.String("from", "", "start date of custom range, YYYY-MM-DD")
+	to := flags.String("to", "", "end date of custom range, YYYY-MM-DD")
+	repos := flags.String("repo", "", "comma separated repository names, all if empty")
+	out := flags.String("out", "", "output file, stdout if empty")
+	flags.Parse(args)
+
+	query := url.Values{}
+	query.Set("range", *trafficRange)
+	query.Set("from", *from)
+	query.Set("to", *to)
+	query.Set("repo", *repos)
+	r, err := repo.ParseTrafficRange(query, "7d", time.Now())
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	defer buffered.Flush()
+
+	writer, err := repo.NewExportWriter(*format, buffered)
+	if err != nil {
+		return err
+	}
+
+	rows := 0
+	filter := repo.ExportFilter{Repos: repo.ParseRepoFilter(query), Range: r}
+	err = repo.StoreStreamTrafficWithMeta(context.Background(), filter, func(row repo.ExportRow) error {
+		rows++
+		return writer.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	logger.Info("export done", "rows", rows)
+	return nil
+}
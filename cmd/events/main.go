@@ -3,62 +3,275 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"miikka.xyz/devops-app/cache"
 	"miikka.xyz/devops-app/consts"
 	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/jobs"
+	"miikka.xyz/devops-app/jobs/github_traffic"
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/lib/webhook"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+	"miikka.xyz/devops-app/store"
+	"miikka.xyz/devops-app/tracing"
+	"miikka.xyz/devops-app/utils"
 )
 
 func main() {
+	shutdownTracing, err := tracing.Init(context.Background(), consts.ServiceEvents)
+	if err != nil {
+		logger.Fatal("initializing tracing failed", logger.FieldError, err)
+	}
+	defer shutdownTracing(context.Background())
+
+	metrics.Listen(utils.GetEnv("METRICS_PORT", "9100"))
+
+	// Deferred functions run in reverse order: channel, connection and then database are closed
+	defer store.Close()
+
+	// Unique indexes keep concurrent inserts from creating duplicates
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), time.Second*30)
+	if err := store.EnsureIndexes(indexCtx); err != nil {
+		logger.Error("creating indexes failed", logger.FieldError, err)
+	}
+	cancelIndexes()
+
 	// The messagesChannel is the event queue
-	rabbitConn, rabbitCh, messagesChannel := events.CreateEventQueue(consts.QueueEventsName)
+	rabbitConn, rabbitCh, messagesChannel := events.CreateEventQueue(consts.QueueEventsName, consts.ServiceEvents)
 	defer rabbitConn.Close()
 	defer rabbitCh.Close()
+	if err := events.DeclareStoredExchange(rabbitCh); err != nil {
+		logger.Fatal("declaring exchange failed", "exchange", consts.ExchangeStoredEvents, logger.FieldError, err)
+	}
 
-	// Make a blocking channel
-	foreverCh := make(chan bool)
+	// Requested jobs publish events and refresh cache like the cron job
+	cacheClient, _ := cache.New(false)
+	defer cacheClient.Close()
+	// Webhooks are sent in background so slow endpoints don't block the queue
+	hooks := webhook.WorkerFromEnv()
+	hooks.Start()
+	// Deliveries of a consumer that died are left pending
+	resumeCtx, cancelResume := context.WithTimeout(context.Background(), time.Second*30)
+	if _, err := hooks.ResumeStale(resumeCtx); err != nil {
+		logger.Error("resuming stale webhook deliveries failed", logger.FieldError, err)
+	}
+	cancelResume()
+	// Requested jobs run in background so those don't block the queue
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	c := &consumer{ch: rabbitCh, cache: cacheClient, webhooks: hooks, jobCtx: jobCtx}
 
-	// Loop event queue in background
+	// Loop event queue in background. Loop ends when consuming is canceled and
+	// every delivered message has been processed.
+	doneCh := make(chan struct{})
 	go func() {
-		// Each dot in message increases sleep time
+		defer close(doneCh)
 		for msg := range messagesChannel {
 			// Process each message from queue
-			processMessage(msg)
+			c.processMessage(msg)
 		}
 	}()
 
-	log.Println("Waiting messages...")
-	<-foreverCh
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("waiting messages")
+	select {
+	case <-doneCh:
+		logger.Error("event queue was closed")
+		return
+	case <-signalCtx.Done():
+		stop()
+	}
+
+	// Stop new deliveries, messages already delivered are still processed and acked
+	timeout := utils.GetEnvDuration("SHUTDOWN_TIMEOUT", time.Second*25)
+	logger.Info("shutting down", "timeout", timeout.String())
+	if err := rabbitCh.Cancel(consts.ServiceEvents, false); err != nil {
+		logger.Error("canceling consumer failed", logger.FieldError, err)
+	}
+	deadline := time.Now().Add(timeout)
+	select {
+	case <-doneCh:
+		logger.Info("in-flight messages processed")
+	case <-time.After(timeout):
+		// Unacked messages are requeued when channel closes
+		logger.Warn("in-flight messages were not processed before timeout")
+	}
+
+	// Running jobs get the rest of the timeout. Canceled ones are recorded failed.
+	jobsDone := make(chan struct{})
+	go func() {
+		c.jobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-time.After(time.Until(deadline)):
+		logger.Warn("requested jobs were interrupted, trigger them again")
+		cancelJobs()
+		select {
+		case <-jobsDone:
+		case <-time.After(time.Second * 10):
+		}
+	}
+
+	// Queued deliveries get the rest of the timeout, interrupted ones are marked failed
+	stopCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if !hooks.Stop(stopCtx) {
+		logger.Warn("webhook deliveries were interrupted, replay failed deliveries")
+	}
 }
 
-func processMessage(msg amqp.Delivery) {
-	log.Printf("Received message: \n%s\n", string(msg.Body))
+// consumer holds what commands need for running jobs
+type consumer struct {
+	ch       *amqp.Channel
+	cache    *cache.Cache
+	webhooks *webhook.Worker
+	// jobCtx is canceled when running jobs don't finish before shutdown timeout
+	jobCtx context.Context
+	jobs   sync.WaitGroup
+}
 
+func (c *consumer) processMessage(msg amqp.Delivery) {
 	event := events.Event{}
 	err := json.Unmarshal(msg.Body, &event)
 	if err != nil {
-		log.Println(err)
+		logger.Error("invalid message", "body", string(msg.Body), logger.FieldError, err)
+		metrics.EventsConsumed.WithLabelValues("unknown", "invalid").Inc()
+		// Invalid message would fail again, so it's not requeued
+		msg.Nack(false, false)
 		return
 	}
+	// Older publishers set correlation ID only as message property
+	if event.CorrelationID == "" {
+		event.CorrelationID = msg.CorrelationId
+	}
+	log := logger.With(logger.FieldCorrelationID, event.CorrelationID, "type", event.Type)
+
+	// Continue the trace of the publisher
+	ctx := events.ExtractTraceContext(logger.NewContext(context.Background(), log), msg)
+	ctx, span := tracing.Start(ctx, consts.QueueEventsName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination", consts.QueueEventsName),
+			attribute.String("event.type", event.Type),
+		),
+	)
+	defer span.End()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*45)
+	storeCtx, cancel := context.WithTimeout(ctx, time.Second*45)
 	defer cancel()
 
+	log.Info("received event")
+	result := "success"
+	stored, err := storeEvent(storeCtx, &event)
+	if err != nil {
+		log.Error("storing event failed", logger.FieldError, err)
+		tracing.RecordError(span, err)
+		result = "failure"
+	}
+	// Live streams of API replicas get events only after those can be read from database
+	if stored {
+		if err := events.Broadcast(ctx, c.ch, &event); err != nil {
+			log.Warn("broadcasting event failed", logger.FieldError, err)
+		}
+		if err := c.webhooks.Dispatch(storeCtx, event); err != nil {
+			log.Error("creating webhook deliveries failed", logger.FieldError, err)
+		}
+	}
+
+	// Commands are acked after those have been run. Requested job is acked once
+	// its run is recorded and runs in background.
 	switch event.Type {
-	case consts.EventTrafficJobCompleted:
-		log.Println("received traffic job completed event")
-		id, err := events.StoreCreateEvent(ctx, &events.Event{
-			CreatedAt: time.Now(),
-			Type:      consts.EventTrafficJobCompleted,
-		})
-		if err != nil {
-			log.Println(err)
-			break
+	case consts.EventTrafficJobRequested:
+		if err := c.runRequestedJob(ctx, &event); err != nil {
+			result = "failure"
+		}
+	case consts.EventWebhookReplayRequested:
+		if err := c.replayWebhooks(storeCtx, &event); err != nil {
+			log.Error("replaying webhook deliveries failed", logger.FieldError, err)
+			result = "failure"
 		}
-		log.Println("event stored to database with id:", id.Hex())
 	}
-	log.Println("Done")
+	metrics.EventsConsumed.WithLabelValues(event.Type, result).Inc()
 	msg.Ack(false)
 }
+
+// runRequestedJob marks run requested by admin running and starts the job in
+// background. Run ID comes from the request, so redelivered command runs the
+// same run again unless it has already finished.
+func (c *consumer) runRequestedJob(ctx context.Context, event *events.Event) error {
+	runID := event.CorrelationID
+	if runID == "" {
+		runID = logger.NewID()
+	}
+	log := logger.FromContext(ctx).With(logger.FieldRunID, runID)
+
+	j := &github_traffic.Job{Cache: c.cache}
+	requestedBy, _ := event.Data["requested_by"].(string)
+	run := &job.Run{RunID: runID, Job: j.Name(), Trigger: job.TriggerAdmin, RequestedBy: requestedBy, StartedAt: time.Now()}
+	started, err := job.StoreStartRun(ctx, run)
+	if err != nil {
+		log.Error("recording job run failed", logger.FieldError, err)
+		return err
+	}
+	if !started {
+		log.Warn("job run already finished")
+		return nil
+	}
+
+	opts := jobs.OptionsFromEnv(job.TriggerAdmin)
+	opts.RunID = runID
+	opts.RequestedBy = requestedBy
+	runner := &jobs.Runner{Channel: c.ch}
+	// Job continues the trace of the command but not its timeout
+	runCtx := trace.ContextWithSpan(logger.NewContext(c.jobCtx, logger.FromContext(ctx)), trace.SpanFromContext(ctx))
+	c.jobs.Add(1)
+	go func() {
+		defer c.jobs.Done()
+		runner.Run(runCtx, j, opts)
+	}()
+	return nil
+}
+
+// replayWebhooks queues failed deliveries of the command again. Deliveries
+// that are not failed anymore are skipped, so redelivered command is harmless.
+func (c *consumer) replayWebhooks(ctx context.Context, event *events.Event) error {
+	deliveryID, webhookID, err := webhook.ReplayIDs(event)
+	if err != nil {
+		return err
+	}
+	_, err = c.webhooks.Replay(ctx, deliveryID, webhookID)
+	return err
+}
+
+// storeEvent saves event to database and reports whether it was saved. Events
+// with a key are saved only once, unique index of key rejects the rest.
+func storeEvent(ctx context.Context, event *events.Event) (bool, error) {
+	log := logger.FromContext(ctx)
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	id, err := events.StoreCreateEvent(ctx, event)
+	if event.Key != "" && mongo.IsDuplicateKeyError(err) {
+		log.Info("event already stored", "key", event.Key)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Info("event stored to database", logger.FieldEventID, id.Hex())
+	return true, nil
+}
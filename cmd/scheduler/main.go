@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"miikka.xyz/devops-app/cache"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/jobs"
+	"miikka.xyz/devops-app/jobs/github_traffic"
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+	"miikka.xyz/devops-app/scheduler"
+	"miikka.xyz/devops-app/store"
+	"miikka.xyz/devops-app/tracing"
+	"miikka.xyz/devops-app/utils"
+)
+
+// staleRunAge is how long a run may be running before maintenance marks it failed
+const staleRunAge = time.Hour * 2
+
+func main() {
+	shutdownTracing, err := tracing.Init(context.Background(), consts.ServiceScheduler)
+	if err != nil {
+		logger.Fatal("initializing tracing failed", logger.FieldError, err)
+	}
+	defer shutdownTracing(context.Background())
+
+	defer store.Close()
+	rabbitConn, rabbitCh := events.CreateQueue(consts.QueueEventsName)
+	defer rabbitConn.Close()
+	defer rabbitCh.Close()
+	cacheClient, _ := cache.New(false)
+	defer cacheClient.Close()
+
+	metrics.Listen(utils.GetEnv("METRICS_PORT", "9100"))
+
+	maxConcurrent, err := strconv.Atoi(utils.GetEnv("SCHEDULER_MAX_CONCURRENT", "1"))
+	if err != nil {
+		logger.Fatal("invalid SCHEDULER_MAX_CONCURRENT", logger.FieldError, err)
+	}
+	config := scheduler.Config{
+		Jitter:        utils.GetEnvDuration("SCHEDULER_JITTER", time.Second*30),
+		CatchUp:       utils.GetEnv("SCHEDULER_CATCH_UP", scheduler.CatchUpOnce),
+		MaxConcurrent: maxConcurrent,
+	}
+	elector := scheduler.NewRedisElector(cacheClient.UniversalClient, utils.GetEnvDuration("SCHEDULER_LEADER_TTL", time.Second*30))
+	s, err := scheduler.New(config, elector, scheduler.RedisState{Client: cacheClient.UniversalClient})
+	if err != nil {
+		logger.Fatal("invalid scheduler config", logger.FieldError, err)
+	}
+
+	runner := &jobs.Runner{Channel: rabbitCh}
+	trafficJob := &github_traffic.Job{Cache: cacheClient}
+	retention := utils.GetEnvDuration("JOB_RUNS_RETENTION", time.Hour*24*90)
+	tasks := []scheduler.Task{
+		{
+			Name:     consts.JobGithubTraffic,
+			Schedule: utils.GetEnv("SCHEDULE_TRAFFIC_JOB", "0 */6 * * *"),
+			Run: func(ctx context.Context) error {
+				return runner.Run(ctx, trafficJob, jobs.OptionsFromEnv(job.TriggerSchedule))
+			},
+		},
+		{
+			Name:     "cache_rebuild",
+			Schedule: utils.GetEnv("SCHEDULE_CACHE_REBUILD", "*/30 * * * *"),
+			Run: func(ctx context.Context) error {
+				ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+				defer cancel()
+				return cacheClient.UpdateTrafficCache(ctx)
+			},
+		},
+		{
+			Name:     "maintenance",
+			Schedule: utils.GetEnv("SCHEDULE_MAINTENANCE", "30 3 * * *"),
+			Run: func(ctx context.Context) error {
+				return maintenance(ctx, retention)
+			},
+		},
+	}
+	for _, task := range tasks {
+		if err := s.Add(task); err != nil {
+			logger.Fatal("adding task failed", logger.FieldError, err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Only the leader fires tasks. Lock is released on shutdown.
+	electorDone := make(chan struct{})
+	go func() {
+		defer close(electorDone)
+		elector.Run(ctx)
+	}()
+
+	// Blocks until signal and running tasks have finished
+	s.Start(ctx)
+	<-electorDone
+	logger.Info("scheduler stopped")
+}
+
+// maintenance marks runs left running by dead processes as failed and deletes old runs
+func maintenance(ctx context.Context, retention time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	failed, err := job.StoreFailStaleRuns(ctx, time.Now().Add(-staleRunAge))
+	if err != nil {
+		return err
+	}
+	deleted, err := job.StoreDeleteRunsBefore(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	logger.FromContext(ctx).Info("maintenance done", "stale_runs", failed, "deleted_runs", deleted)
+	return nil
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
-	"log"
-	"time"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"miikka.xyz/devops-app/cache"
 	"miikka.xyz/devops-app/consts"
 	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/jobs"
 	"miikka.xyz/devops-app/jobs/github_traffic"
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
 	"miikka.xyz/devops-app/store"
+	"miikka.xyz/devops-app/tracing"
 )
 
 func main() {
@@ -21,32 +23,25 @@ func main() {
 	// TODO: Refactor init() in store
 	defer store.Close()
 
-	// Run job
-	log.Println("Starting to run a github repository traffic job")
-	err := github_traffic.DoGithubTrafficStats()
+	// Deferred before the job runs, so spans of the run get flushed
+	shutdownTracing, err := tracing.Init(context.Background(), consts.ServiceTrafficJob)
 	if err != nil {
-		log.Println("job failed", err)
+		logger.Fatal("initializing tracing failed", logger.FieldError, err)
 	}
-	log.Println("job completed successfully")
+	defer shutdownTracing(context.Background())
 
-	// Publish event
-	event := events.Event{
-		CreatedAt: time.Now(),
-		ObjectID:  primitive.NilObjectID,
-		Type:      consts.EventTrafficJobCompleted,
-	}
-	if err := events.Publish(rabbitCh, &event); err != nil {
-		log.Println("publishing event failed", err)
-		return
-	}
-	log.Println("traffic job completed event published")
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
+	// Job is short-lived, so metrics are pushed instead of scraped
+	defer func() {
+		if err := metrics.Push("traffic_job"); err != nil {
+			logger.Warn("pushing metrics failed", logger.FieldError, err)
+		}
+	}()
 
-	// Update cache
+	// Run job, publish events and update cache
+	logger.Info("starting to run a github repository traffic job")
 	cacheClient, _ := cache.New(false)
-	cacheClient.UpdateTrafficCache(ctx, 0)
-	log.Println("cache updated")
-	log.Println("exit...")
+	defer cacheClient.Close()
+	runner := &jobs.Runner{Channel: rabbitCh}
+	runner.Run(context.Background(), &github_traffic.Job{Cache: cacheClient}, jobs.OptionsFromEnv(job.TriggerCron))
+	logger.Info("exit...")
 }
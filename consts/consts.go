@@ -1,8 +1,9 @@
 package consts
 
 import (
-	"log"
 	"os"
+
+	"miikka.xyz/devops-app/logger"
 )
 
 var (
@@ -14,6 +15,18 @@ var (
 // Event queue
 const QueueEventsName = "events_queue_durable"
 
+// ExchangeStoredEvents is a fanout exchange of events that have been saved to database.
+// Every API replica consumes it with its own exclusive queue.
+const ExchangeStoredEvents = "events_stored"
+
+// Service names used in traces
+const (
+	ServiceAPI        = "devops-api"
+	ServiceEvents     = "devops-events"
+	ServiceTrafficJob = "traffic-job"
+	ServiceScheduler  = "devops-scheduler"
+)
+
 // Errors
 const (
 	ErrBody          = "Invalid request body"
@@ -30,15 +43,39 @@ const (
 	CollectionEvents      = "events"
 	CollectionRepoTraffic = "repo_traffic"
 	CollectionRepos       = "repos"
+	CollectionJobRuns     = "job_runs"
+	CollectionAPITokens   = "api_tokens"
+	CollectionAuditLog    = "audit_log"
+	CollectionWebhooks    = "webhooks"
+	CollectionDeliveries  = "webhook_deliveries"
 )
 
 // AllCollections should hold anmes of all collections so those can be erased easily
-var AllCollections = []string{CollectionUsers, CollectionEvents, CollectionRepoTraffic, CollectionRepos}
+var AllCollections = []string{CollectionUsers, CollectionEvents, CollectionRepoTraffic, CollectionRepos, CollectionJobRuns, CollectionAPITokens, CollectionAuditLog, CollectionWebhooks, CollectionDeliveries}
 
 // Events
 const (
-	EventUserCreated         = "user_created"
+	EventUserCreated = "user_created"
+	// Every job run publishes these
+	EventJobStarted   = "job_started"
+	EventJobCompleted = "job_completed"
+	EventJobFailed    = "job_failed"
+	// Traffic job published these before job events, kept for stored events
 	EventTrafficJobCompleted = "traffic_completed"
+	EventTrafficJobFailed    = "traffic_failed"
+	EventDailySummary        = "daily_summary"
+	EventTrafficSpike        = "traffic_spike"
+	EventRepoAdded           = "repo_added"
+	EventRepoRemoved         = "repo_removed"
+	// EventTrafficJobRequested is a command, events consumer runs the job when it receives this
+	EventTrafficJobRequested = "traffic_job_requested"
+	// EventWebhookReplayRequested is a command, events consumer sends failed webhook deliveries again
+	EventWebhookReplayRequested = "webhook_replay_requested"
+)
+
+// Jobs
+const (
+	JobGithubTraffic = "github_traffic"
 )
 
 // Other
@@ -49,10 +86,16 @@ const (
 // Database
 var DatabaseName = "this_will_change"
 
+// GithubOwner is the user whose repositories are tracked
+var GithubOwner = "tuommii"
+
 func init() {
 	DatabaseName = "laboratory"
+	if owner := os.Getenv("GITHUB_OWNER"); owner != "" {
+		GithubOwner = owner
+	}
 	if os.Getenv("TEST_MODE") == "1" {
 		DatabaseName = "test"
-		log.Println("TEST MODE")
+		logger.Info("test mode")
 	}
 }
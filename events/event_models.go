@@ -13,4 +13,10 @@ type Event struct {
 	Type         string               `bson:"type,omitempty"`
 	CreatedAt    time.Time            `bson:"created_at,omitempty"`
 	Acknowledged []primitive.ObjectID `bson:"ackd"`
+	// Key identifies events that should be stored only once, like a daily summary
+	Key string `bson:"key,omitempty"`
+	// CorrelationID is request or job run ID that caused the event
+	CorrelationID string `bson:"correlation_id,omitempty"`
+	// Data is event specific payload
+	Data map[string]interface{} `bson:"data,omitempty"`
 }
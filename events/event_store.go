@@ -6,6 +6,7 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"miikka.xyz/devops-app/consts"
 	"miikka.xyz/devops-app/store"
 )
@@ -25,6 +26,28 @@ func StoreCreateEvent(ctx context.Context, event *Event) (primitive.ObjectID, er
 	return id, nil
 }
 
+// StoreGetLatestEvents returns newest events of given types. All types if types is empty.
+func StoreGetLatestEvents(ctx context.Context, types []string, limit int64) ([]Event, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
+
+	filter := bson.M{}
+	if len(types) > 0 {
+		filter["type"] = bson.M{"$in": types}
+	}
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(limit)
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
 func StoreGetEventByID(ctx context.Context, id primitive.ObjectID) (*Event, error) {
 	client := store.GetClient()
 	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
@@ -3,7 +3,6 @@ package github_traffic
 import (
 	"context"
 	"errors"
-	"log"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -13,9 +12,14 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/oauth2"
 	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
 	"miikka.xyz/devops-app/store"
+	"miikka.xyz/devops-app/tracing"
 )
 
 // client holds global Github API client. Using global so every job doesn't need to create a client
@@ -24,8 +28,9 @@ var client *github.Client
 
 // WorkerResult represents data that each worker sends to the results channel
 type WorkerResult struct {
-	RepoName     string
-	TrafficViews *github.TrafficViews
+	RepoName      string
+	TrafficViews  *github.TrafficViews
+	TrafficClones *github.TrafficClones
 }
 
 // init Github API client in package's init function
@@ -34,13 +39,32 @@ func init() {
 		&oauth2.Token{AccessToken: os.Getenv("GITHUB_API_TOKEN")},
 	)
 	tokenClient := oauth2.NewClient(context.Background(), tokenSource)
+	// GitHub API calls are traced as child spans of the job run
+	tokenClient.Transport = otelhttp.NewTransport(tokenClient.Transport)
 	client = github.NewClient(tokenClient)
 	client.Client().Timeout = time.Second * 45
 }
 
+// jobName is used in run records, events and metrics
+const jobName = consts.JobGithubTraffic
+
 // DoGithubTrafficStats will get user's traffic data (visitor counts) from GitHub and saves those
-// to database
-func DoGithubTrafficStats() error {
+// to database. Returned report tells what changed during the run. Every log entry of the run
+// has the runID, which is also used as correlation ID of the report's events.
+func DoGithubTrafficStats(ctx context.Context, runID string) (report *Report, err error) {
+	log := logger.FromContext(ctx).With(logger.FieldRunID, runID)
+	ctx, span := tracing.Start(ctx, jobName)
+	span.SetAttributes(attribute.String(logger.FieldRunID, runID))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	defer func() {
+		if err == nil {
+			metrics.JobReposProcessed.WithLabelValues(jobName).Set(float64(report.Repos))
+		}
+	}()
+
 	// How many repositories will be retrieved at once.
 	// Those will be then splitted for each worker.
 	const pageSize = 100
@@ -52,10 +76,20 @@ func DoGithubTrafficStats() error {
 	doneCh := make(chan bool)
 
 	// All workers will be canceled when first error occurs
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(logger.NewContext(ctx, log))
 	defer cancel()
 
-	go listenResultsChannel(ctx, cancel, resultsCh, doneCh, &errorHasOccured)
+	// Listener fills report with traffic, main goroutine reads it after doneCh
+	report = newReport(runID)
+	go listenResultsChannel(ctx, cancel, resultsCh, doneCh, &errorHasOccured, report)
+
+	// On the first run every repository would be reported as new
+	repoCount, err := store.GetClient().Database(consts.DatabaseName).Collection(consts.CollectionRepos).CountDocuments(ctx, bson.M{})
+	if err != nil {
+		close(resultsCh)
+		return nil, err
+	}
+	seenRepos := make([]string, 0)
 
 	// Only repositories where user is a owner, max pageSize at time
 	options := &github.RepositoryListOptions{Affiliation: "owner", ListOptions: github.ListOptions{PerPage: pageSize}}
@@ -65,24 +99,31 @@ func DoGithubTrafficStats() error {
 	for {
 		// Don't fetch more repositories if worker has failed
 		if errorHasOccured > 0 {
-			log.Println("cancel job, error has occured")
+			log.Warn("cancel job, error has occured")
 			close(resultsCh)
 			break
 		}
 
 		repos, resp, err := client.Repositories.List(ctx, "", options)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		log.Println("page", i, "has", len(repos), "repositories")
+		recordRateLimit(resp)
+		log.Info("fetched page", "page", i, "repos", len(repos))
 
 		// Save repository data like repo URL to different collection
-		err = saveRepositoryData(ctx, repos, &errorHasOccured)
+		newRepos, err := saveRepositoryData(ctx, repos, &errorHasOccured)
 		if err != nil {
-			log.Println(err)
+			log.Error("saving repository data failed", logger.FieldError, err)
 			atomic.AddInt64(&errorHasOccured, 1)
 			cancel()
-			return err
+			return nil, err
+		}
+		if repoCount > 0 {
+			report.NewRepos = append(report.NewRepos, newRepos...)
+		}
+		for _, r := range repos {
+			seenRepos = append(seenRepos, r.GetName())
 		}
 
 		var workerWG sync.WaitGroup
@@ -93,7 +134,7 @@ func DoGithubTrafficStats() error {
 
 		// All pages fetched
 		if resp.NextPage == 0 {
-			log.Println("this was last page, close results channel")
+			log.Debug("this was last page, close results channel")
 			close(resultsCh)
 			break
 		}
@@ -106,15 +147,25 @@ func DoGithubTrafficStats() error {
 	<-doneCh
 
 	if errorHasOccured > 0 {
-		return errors.New("job failed")
+		return nil, errors.New("job failed")
 	}
 
-	return nil
+	report.Repos = len(seenRepos)
+	report.RemovedRepos, err = markRemovedRepositories(ctx, seenRepos)
+	if err != nil {
+		return nil, err
+	}
+	report.FinishedAt = time.Now()
+	report.analyze(report.FinishedAt)
+
+	return report, nil
 }
 
 // saveResultParams holds parameters for saveResults-function
 type saveResultParams struct {
-	view            *github.TrafficData
+	view *github.TrafficData
+	// fields are names of count and unique count fields, views or clones
+	fields          trafficFields
 	coll            *mongo.Collection
 	operations      *[]mongo.WriteModel
 	i               *int
@@ -124,7 +175,8 @@ type saveResultParams struct {
 }
 
 // listenResultsChannel collects results from workers
-func listenResultsChannel(ctx context.Context, cancel func(), resultsCh chan *WorkerResult, doneCh chan bool, errorHasOccured *int64) {
+func listenResultsChannel(ctx context.Context, cancel func(), resultsCh chan *WorkerResult, doneCh chan bool, errorHasOccured *int64, report *Report) {
+	log := logger.FromContext(ctx)
 	defer func() {
 		doneCh <- true
 		close(doneCh)
@@ -144,14 +196,28 @@ func listenResultsChannel(ctx context.Context, cancel func(), resultsCh chan *Wo
 			continue
 		}
 
-		// Each result has array of views
+		// Each result has array of views and array of clones
+		params.repoName = workerResult.RepoName
+		report.views[workerResult.RepoName] = workerResult.TrafficViews.Views
+		report.clones[workerResult.RepoName] = workerResult.TrafficClones.Clones
+		params.fields = viewFields
 		for _, view := range workerResult.TrafficViews.Views {
 			params.view = view
-			params.repoName = workerResult.RepoName
 			err := saveResults(ctx, cancel, params)
 			if err != nil {
-				log.Println(err)
-				atomic.AddInt64(params.errorHasOccured, 1)
+				log.Error("saving results failed", logger.FieldError, err)
+				atomic.AddInt64(errorHasOccured, 1)
+				cancel()
+				return
+			}
+		}
+		params.fields = cloneFields
+		for _, clone := range workerResult.TrafficClones.Clones {
+			params.view = clone
+			err := saveResults(ctx, cancel, params)
+			if err != nil {
+				log.Error("saving results failed", logger.FieldError, err)
+				atomic.AddInt64(errorHasOccured, 1)
 				cancel()
 				return
 			}
@@ -166,17 +232,27 @@ func listenResultsChannel(ctx context.Context, cancel func(), resultsCh chan *Wo
 	// Save rest of the results
 	_, err := params.coll.BulkWrite(ctx, *params.operations, &options.BulkWriteOptions{})
 	if err != nil {
-		log.Println(err)
+		log.Error("saving results failed", logger.FieldError, err)
 		atomic.AddInt64(errorHasOccured, 1)
 		cancel()
 		return
 	}
 }
 
+// trafficFields are database fields of one traffic type
+type trafficFields struct {
+	count  string
+	unique string
+}
+
+var (
+	viewFields  = trafficFields{count: "views", unique: "unique_views"}
+	cloneFields = trafficFields{count: "clones", unique: "unique_clones"}
+)
+
 // saveResults collects results and saves those to database when amount of saveAtOnce is exceeded
 // TODO: Transactions, replica mode in docker?
 func saveResults(ctx context.Context, cancel func(), params saveResultParams) error {
-	log.Println(params.repoName, params.view.Timestamp.String()[:10], *params.view.Count, *params.view.Uniques)
 
 	nameAndTimestampFilter := []bson.M{
 		{"name": params.repoName},
@@ -186,10 +262,10 @@ func saveResults(ctx context.Context, cancel func(), params saveResultParams) er
 
 	update := bson.M{
 		"$set": bson.M{
-			"name":         params.repoName,
-			"views":        *params.view.Count,
-			"unique_views": *params.view.Uniques,
-			"timestamp":    params.view.Timestamp.Time,
+			"name":               params.repoName,
+			params.fields.count:  *params.view.Count,
+			params.fields.unique: *params.view.Uniques,
+			"timestamp":          params.view.Timestamp.Time,
 		},
 	}
 
@@ -214,8 +290,9 @@ func saveResults(ctx context.Context, cancel func(), params saveResultParams) er
 // launchWorkers start's goroutines for each worker
 func launchWorkers(ctx context.Context, cancel func(), resultsCh chan *WorkerResult, wg *sync.WaitGroup, chunk []*github.Repository, errorHasOccured *int64) {
 	defer wg.Done()
+	log := logger.FromContext(ctx)
 	const workersCount = 2
-	log.Println("workers count", workersCount)
+	log.Debug("launching workers", "workers", workersCount)
 
 	// Split array equally to each worker, last one takes extra ones
 	chunkLen := len(chunk)
@@ -238,17 +315,18 @@ func launchWorkers(ctx context.Context, cancel func(), resultsCh chan *WorkerRes
 
 // runWorker runs task for each repository in chunk
 func runWorker(ctx context.Context, cancel func(), resultsCh chan *WorkerResult, wg *sync.WaitGroup, errorHasOccured *int64, chunk []*github.Repository, index int) {
+	log := logger.FromContext(ctx).With("worker", index)
 	defer func() {
-		log.Println("worker", index, "- done!")
+		log.Debug("worker done")
 		wg.Done()
 	}()
-	log.Println("started worker", index, "with", len(chunk), "elements")
+	log.Debug("started worker", "repos", len(chunk))
 
 	for _, elem := range chunk {
 		// Before doing next task, check if context is already canceled / other worker has failed.
 		select {
 		case <-ctx.Done():
-			log.Println("some worker has failed, shutting down worker", index)
+			log.Warn("some worker has failed, shutting down worker")
 			atomic.AddInt64(errorHasOccured, 1)
 			return
 		default:
@@ -262,23 +340,44 @@ func runWorker(ctx context.Context, cancel func(), resultsCh chan *WorkerResult,
 // runWorkerTask does the actual task
 func runWorkerTask(ctx context.Context, cancel func(), resultsCh chan *WorkerResult, repo *github.Repository, index int, errorHasOccured *int64) {
 	// Fetch views for repo
-	views, _, err := client.Repositories.ListTrafficViews(ctx, "tuommii", *repo.Name, &github.TrafficBreakdownOptions{})
+	views, resp, err := client.Repositories.ListTrafficViews(ctx, consts.GithubOwner, *repo.Name, &github.TrafficBreakdownOptions{})
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("fetching views failed", "repo", repo.GetName(), logger.FieldError, err)
 		atomic.AddInt64(errorHasOccured, 1)
 		cancel()
 		return
 	}
 
+	recordRateLimit(resp)
+
+	// Fetch clones for repo
+	clones, resp, err := client.Repositories.ListTrafficClones(ctx, consts.GithubOwner, *repo.Name, &github.TrafficBreakdownOptions{})
+	if err != nil {
+		logger.FromContext(ctx).Error("fetching clones failed", "repo", repo.GetName(), logger.FieldError, err)
+		atomic.AddInt64(errorHasOccured, 1)
+		cancel()
+		return
+	}
+	recordRateLimit(resp)
+
 	// Send data to channel
 	res := &WorkerResult{
-		RepoName:     *repo.Name,
-		TrafficViews: views,
+		RepoName:      *repo.Name,
+		TrafficViews:  views,
+		TrafficClones: clones,
 	}
 	resultsCh <- res
 }
 
-func saveRepositoryData(ctx context.Context, repos []*github.Repository, errorHasOccured *int64) error {
+// recordRateLimit updates rate limit metric from GitHub response
+func recordRateLimit(resp *github.Response) {
+	if resp != nil {
+		metrics.GithubRateLimitRemaining.Set(float64(resp.Rate.Remaining))
+	}
+}
+
+// saveRepositoryData saves repository data and returns names of repositories that were not in database
+func saveRepositoryData(ctx context.Context, repos []*github.Repository, errorHasOccured *int64) ([]string, error) {
 	operations := make([]mongo.WriteModel, 0)
 	for _, r := range repos {
 		filter := bson.M{"name": r.Name}
@@ -286,7 +385,10 @@ func saveRepositoryData(ctx context.Context, repos []*github.Repository, errorHa
 			"$set": bson.M{
 				"name": r.Name,
 				"url":  r.GetHTMLURL(),
-			}}
+			},
+			// Repository might have been removed earlier
+			"$unset": bson.M{"removed_at": ""},
+		}
 		updateModel := mongo.NewUpdateOneModel()
 		updateModel.SetFilter(filter)
 		updateModel.SetUpdate(update)
@@ -295,10 +397,16 @@ func saveRepositoryData(ctx context.Context, repos []*github.Repository, errorHa
 	}
 
 	coll := store.GetClient().Database(consts.DatabaseName).Collection(consts.CollectionRepos)
-	_, err := coll.BulkWrite(ctx, operations, &options.BulkWriteOptions{})
+	res, err := coll.BulkWrite(ctx, operations, &options.BulkWriteOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Println("saving repo data succeed")
-	return nil
+
+	// Upserted IDs are keyed by index of the operation
+	newRepos := make([]string, 0, len(res.UpsertedIDs))
+	for index := range res.UpsertedIDs {
+		newRepos = append(newRepos, repos[index].GetName())
+	}
+	logger.FromContext(ctx).Debug("saving repo data succeed", "repos", len(repos))
+	return newRepos, nil
 }
@@ -1,6 +1,7 @@
 package github_traffic
 
 import (
+	"context"
 	"testing"
 
 	"miikka.xyz/devops-app/store"
@@ -10,7 +11,7 @@ func TestJob(t *testing.T) {
 	teardown := store.SetupTest(t)
 	defer teardown()
 
-	err := DoGithubTrafficStats()
+	_, err := DoGithubTrafficStats(context.Background(), "test")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,112 @@
+package github_traffic
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"miikka.xyz/devops-app/jobs"
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/logger"
+)
+
+// Job fetches traffic of all repositories. It is run with jobs.Runner.
+type Job struct {
+	// Cache is refreshed after successful fetch, skipped when nil
+	Cache job.CacheRefresher
+}
+
+// Name of the job
+func (j *Job) Name() string {
+	return jobName
+}
+
+// Run fetches traffic and queues events of the report
+func (j *Job) Run(ctx context.Context, reporter jobs.Reporter) error {
+	report, err := DoGithubTrafficStats(ctx, reporter.RunID())
+	if err != nil {
+		return err
+	}
+
+	reporter.Set("repos", report.Repos)
+	reporter.Set("new_repos", len(report.NewRepos))
+	reporter.Set("removed_repos", len(report.RemovedRepos))
+	reporter.Set("spikes", len(report.Spikes))
+	reporter.SetReport(report.RunReport())
+	// Daily summary and other notable events
+	for _, event := range report.Events() {
+		reporter.Publish(event)
+	}
+
+	if j.Cache == nil {
+		return nil
+	}
+	// Traffic is already saved, so failing cache update doesn't fail the run.
+	// Cache gets rebuilt later by scheduler.
+	cacheCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	if err := j.Cache.UpdateTrafficCache(cacheCtx); err != nil {
+		reporter.Logger().Warn("updating cache failed", logger.FieldError, err)
+		reporter.Set("cache_updated", false)
+		return nil
+	}
+	reporter.Set("cache_updated", true)
+	return nil
+}
+
+// RunReport is saved to the run record of a successful run
+type RunReport struct {
+	Repos        int          `bson:"repos" json:"repos"`
+	NewRepos     []string     `bson:"new_repos" json:"new_repos"`
+	RemovedRepos []string     `bson:"removed_repos" json:"removed_repos"`
+	PerRepo      []RepoReport `bson:"per_repo" json:"per_repo"`
+}
+
+// RepoReport is traffic of one repository fetched during the run. GitHub returns
+// traffic of the last 14 days.
+type RepoReport struct {
+	Name         string `bson:"name" json:"name"`
+	Views        int    `bson:"views" json:"views"`
+	UniqueViews  int    `bson:"unique_views" json:"unique_views"`
+	Clones       int    `bson:"clones" json:"clones"`
+	UniqueClones int    `bson:"unique_clones" json:"unique_clones"`
+	Spike        bool   `bson:"spike" json:"spike"`
+}
+
+// RunReport returns per repository summary of fetched traffic
+func (r *Report) RunReport() *RunReport {
+	spikes := make(map[string]bool, len(r.Spikes))
+	for _, spike := range r.Spikes {
+		spikes[spike.Repo] = true
+	}
+
+	perRepo := make([]RepoReport, 0, len(r.views))
+	for name, views := range r.views {
+		repo := RepoReport{Name: name, Spike: spikes[name]}
+		for _, v := range views {
+			repo.Views += v.GetCount()
+			repo.UniqueViews += v.GetUniques()
+		}
+		for _, c := range r.clones[name] {
+			repo.Clones += c.GetCount()
+			repo.UniqueClones += c.GetUniques()
+		}
+		perRepo = append(perRepo, repo)
+	}
+	sort.Slice(perRepo, func(i, j int) bool { return perRepo[i].Name < perRepo[j].Name })
+
+	return &RunReport{
+		Repos:        r.Repos,
+		NewRepos:     nonNil(r.NewRepos),
+		RemovedRepos: nonNil(r.RemovedRepos),
+		PerRepo:      perRepo,
+	}
+}
+
+// nonNil makes empty lists to be arrays instead of nulls in JSON
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
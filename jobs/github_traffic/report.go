@@ -0,0 +1,200 @@
+package github_traffic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+	"go.mongodb.org/mongo-driver/bson"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/store"
+)
+
+// Spike detection. Views of the last complete day must be at least spikeFactor times
+// the average of earlier days and at least spikeMinViews. Repository must have
+// traffic from at least spikeMinHistory days before, otherwise first views of a
+// new repository would be a spike.
+const (
+	spikeFactor     = 3.0
+	spikeMinViews   = 10
+	spikeMinHistory = 7
+)
+
+// Report describes what happened during a job run
+type Report struct {
+	// RunID identifies the run in logs and events
+	RunID        string
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	Repos        int
+	NewRepos     []string
+	RemovedRepos []string
+	Spikes       []Spike
+	Summary      DailySummary
+	// views by repository name, used for spikes and summary
+	views map[string][]*github.TrafficData
+	// clones by repository name
+	clones map[string][]*github.TrafficData
+}
+
+// Spike is a day when repository got unusually many views
+type Spike struct {
+	Repo    string
+	Date    time.Time
+	Views   int
+	Average float64
+}
+
+// DailySummary holds traffic of all repositories of the last complete day
+type DailySummary struct {
+	Date         time.Time
+	Views        int
+	UniqueViews  int
+	Clones       int
+	TopRepo      string
+	TopRepoViews int
+}
+
+func newReport(runID string) *Report {
+	return &Report{
+		RunID:     runID,
+		StartedAt: time.Now(),
+		views:     make(map[string][]*github.TrafficData),
+		clones:    make(map[string][]*github.TrafficData),
+	}
+}
+
+// analyze finds spikes and builds summary of the day before 'now'
+func (r *Report) analyze(now time.Time) {
+	day := now.UTC().Truncate(time.Hour*24).AddDate(0, 0, -1)
+	r.Summary = DailySummary{Date: day}
+	r.Spikes = make([]Spike, 0)
+
+	for name, views := range r.views {
+		dayViews, dayUniques, sum, count := 0, 0, 0, 0
+		first := day
+		for _, v := range views {
+			ts := v.GetTimestamp().UTC()
+			switch {
+			case ts.Equal(day):
+				dayViews, dayUniques = v.GetCount(), v.GetUniques()
+			case ts.Before(day):
+				sum += v.GetCount()
+				count++
+				if ts.Before(first) {
+					first = ts
+				}
+			}
+		}
+
+		r.Summary.Views += dayViews
+		r.Summary.UniqueViews += dayUniques
+		if dayViews > r.Summary.TopRepoViews {
+			r.Summary.TopRepo, r.Summary.TopRepoViews = name, dayViews
+		}
+
+		average := 0.0
+		if count > 0 {
+			average = float64(sum) / float64(count)
+		}
+		history := day.Sub(first) >= time.Hour*24*spikeMinHistory
+		if history && dayViews >= spikeMinViews && float64(dayViews) >= spikeFactor*average {
+			r.Spikes = append(r.Spikes, Spike{Repo: name, Date: day, Views: dayViews, Average: average})
+		}
+	}
+
+	for _, clones := range r.clones {
+		for _, c := range clones {
+			if c.GetTimestamp().UTC().Equal(day) {
+				r.Summary.Clones += c.GetCount()
+			}
+		}
+	}
+}
+
+// Events returns events that should be published after successful run. Runner
+// publishes completed event itself. Events
+// that describe a day have a key, so consumer can skip duplicates when job runs
+// many times a day.
+func (r *Report) Events() []events.Event {
+	now := time.Now()
+	date := r.Summary.Date.Format("2006-01-02")
+	list := []events.Event{{
+		CreatedAt: now,
+		Type:      consts.EventDailySummary,
+		Key:       fmt.Sprintf("%s:%s", consts.EventDailySummary, date),
+		Data: map[string]interface{}{
+			"date":           date,
+			"views":          r.Summary.Views,
+			"unique_views":   r.Summary.UniqueViews,
+			"clones":         r.Summary.Clones,
+			"top_repo":       r.Summary.TopRepo,
+			"top_repo_views": r.Summary.TopRepoViews,
+		},
+	}}
+
+	for _, spike := range r.Spikes {
+		date := spike.Date.Format("2006-01-02")
+		list = append(list, events.Event{
+			CreatedAt: now,
+			Type:      consts.EventTrafficSpike,
+			Key:       fmt.Sprintf("%s:%s:%s", consts.EventTrafficSpike, spike.Repo, date),
+			Data: map[string]interface{}{
+				"repo":    spike.Repo,
+				"date":    date,
+				"views":   spike.Views,
+				"average": spike.Average,
+			},
+		})
+	}
+	for _, name := range r.NewRepos {
+		list = append(list, events.Event{
+			CreatedAt: now,
+			Type:      consts.EventRepoAdded,
+			Data:      map[string]interface{}{"repo": name},
+		})
+	}
+	for _, name := range r.RemovedRepos {
+		list = append(list, events.Event{
+			CreatedAt: now,
+			Type:      consts.EventRepoRemoved,
+			Data:      map[string]interface{}{"repo": name},
+		})
+	}
+	for i := range list {
+		list[i].CorrelationID = r.RunID
+	}
+	return list
+}
+
+// markRemovedRepositories marks repositories that were not seen during this run as removed
+func markRemovedRepositories(ctx context.Context, seen []string) ([]string, error) {
+	coll := store.GetClient().Database(consts.DatabaseName).Collection(consts.CollectionRepos)
+	filter := bson.M{"name": bson.M{"$nin": seen}, "removed_at": bson.M{"$exists": false}}
+
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var removed []struct {
+		Name string `bson:"name"`
+	}
+	if err := cursor.All(ctx, &removed); err != nil {
+		return nil, err
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(removed))
+	for _, r := range removed {
+		names = append(names, r.Name)
+	}
+	_, err = coll.UpdateMany(ctx, bson.M{"name": bson.M{"$in": names}}, bson.M{"$set": bson.M{"removed_at": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
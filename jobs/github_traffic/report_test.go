@@ -0,0 +1,39 @@
+package github_traffic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+)
+
+func TestAnalyzeSpikes(t *testing.T) {
+	now := time.Date(2021, 12, 10, 12, 0, 0, 0, time.UTC)
+	day := time.Date(2021, 12, 9, 0, 0, 0, 0, time.UTC)
+	views := func(counts map[int]int) []*github.TrafficData {
+		list := make([]*github.TrafficData, 0)
+		for daysBefore, count := range counts {
+			list = append(list, &github.TrafficData{
+				Timestamp: &github.Timestamp{Time: day.AddDate(0, 0, -daysBefore)},
+				Count:     github.Int(count),
+				Uniques:   github.Int(count),
+			})
+		}
+		return list
+	}
+
+	r := newReport("test")
+	r.views["spike"] = views(map[int]int{0: 60, 3: 5, 8: 5})
+	r.views["quiet"] = views(map[int]int{0: 12, 3: 10, 8: 10})
+	// First views of a new repository are not a spike
+	r.views["new"] = views(map[int]int{0: 60})
+	r.views["recent"] = views(map[int]int{0: 60, 1: 1, 2: 1})
+	r.analyze(now)
+
+	if len(r.Spikes) != 1 || r.Spikes[0].Repo != "spike" || r.Spikes[0].Average != 5 {
+		t.Errorf("%+v", r.Spikes)
+	}
+	if r.Summary.Views != 192 || r.Summary.TopRepo == "quiet" {
+		t.Errorf("%+v", r.Summary)
+	}
+}
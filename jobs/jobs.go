@@ -0,0 +1,254 @@
+// Package jobs runs background jobs. Runner records every run to job_runs,
+// retries failed attempts, enforces timeouts and publishes job_started,
+// job_completed and job_failed events, so a job only has to do its own work.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+	"miikka.xyz/devops-app/tracing"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Job is a unit of background work
+type Job interface {
+	// Name identifies the job in run records, events and metrics
+	Name() string
+	// Run does the work. It is called again on retry, so it should be safe to
+	// run many times. Context is canceled when attempt times out.
+	Run(ctx context.Context, reporter Reporter) error
+}
+
+// Reporter is given to a job for telling what happened during an attempt
+type Reporter interface {
+	RunID() string
+	// Logger has run ID and job name
+	Logger() *logger.Logger
+	// Set adds a value to summary of the run. Summary is saved to run record and
+	// sent with completed event.
+	Set(key string, value interface{})
+	// SetReport sets job specific details that are saved to run record
+	SetReport(report interface{})
+	// Publish queues an event. Events are published only if the run succeeds.
+	Publish(event events.Event)
+}
+
+// RunOptions tell how the job was started and how failures are handled
+type RunOptions struct {
+	// RunID is generated when empty
+	RunID   string
+	Trigger string
+	// RequestedBy is request ID of the admin request, if any
+	RequestedBy string
+	// Timeout of one attempt, no timeout when zero
+	Timeout time.Duration
+	// Retries is how many times failed job is tried again
+	Retries int
+	// RetryDelay is doubled after each failed attempt
+	RetryDelay time.Duration
+}
+
+// OptionsFromEnv returns options with timeout and retries from JOB_TIMEOUT,
+// JOB_RETRIES and JOB_RETRY_DELAY
+func OptionsFromEnv(trigger string) RunOptions {
+	retries, err := strconv.Atoi(utils.GetEnv("JOB_RETRIES", "2"))
+	if err != nil || retries < 0 {
+		logger.Warn("invalid JOB_RETRIES, using default", "value", utils.GetEnv("JOB_RETRIES", ""))
+		retries = 2
+	}
+	return RunOptions{
+		Trigger:    trigger,
+		Timeout:    utils.GetEnvDuration("JOB_TIMEOUT", time.Minute*10),
+		Retries:    retries,
+		RetryDelay: utils.GetEnvDuration("JOB_RETRY_DELAY", time.Second*30),
+	}
+}
+
+// Runner runs jobs
+type Runner struct {
+	// Channel is used for publishing events. Events are not published when nil.
+	Channel *amqp.Channel
+}
+
+// Run runs the job until it succeeds, retries run out or ctx is canceled. Error
+// of the last attempt is returned.
+func (r *Runner) Run(ctx context.Context, j Job, opts RunOptions) (err error) {
+	if opts.RunID == "" {
+		opts.RunID = logger.NewID()
+	}
+	log := logger.With(logger.FieldRunID, opts.RunID, "job", j.Name(), "trigger", opts.Trigger)
+	ctx, span := tracing.Start(logger.NewContext(ctx, log), j.Name()+" run")
+	span.SetAttributes(
+		attribute.String(logger.FieldRunID, opts.RunID),
+		attribute.String("job", j.Name()),
+		attribute.String("trigger", opts.Trigger),
+	)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	start := time.Now()
+	run := &job.Run{
+		RunID:       opts.RunID,
+		Job:         j.Name(),
+		Trigger:     opts.Trigger,
+		Status:      job.StatusRunning,
+		RequestedBy: opts.RequestedBy,
+		StartedAt:   start,
+	}
+	// Job is still run even if it can't be recorded
+	started, err := job.StoreStartRun(ctx, run)
+	if err != nil {
+		log.Error("recording job run failed", logger.FieldError, err)
+	} else if !started {
+		log.Warn("job run already finished")
+		return nil
+	}
+	log.Info("job started")
+	r.publish(ctx, events.Event{
+		Type:          consts.EventJobStarted,
+		CorrelationID: opts.RunID,
+		Data:          map[string]interface{}{"job": j.Name(), "run_id": opts.RunID, "trigger": opts.Trigger},
+	})
+
+	var rep *reporter
+	attempt := 0
+	delay := opts.RetryDelay
+	for {
+		attempt++
+		rep = newReporter(opts.RunID, log.With("attempt", attempt))
+		err = runAttempt(ctx, j, rep, opts.Timeout)
+		if err == nil || attempt > opts.Retries || ctx.Err() != nil {
+			break
+		}
+		log.Warn("job attempt failed, retrying", "attempt", attempt, "retry_in", delay.String(), logger.FieldError, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+
+	duration := time.Since(start)
+	data := map[string]interface{}{
+		"job":         j.Name(),
+		"run_id":      opts.RunID,
+		"attempts":    attempt,
+		"duration_ms": duration.Milliseconds(),
+	}
+	result := job.Result{Attempts: attempt, Err: err}
+	if err != nil {
+		result.Status = job.StatusFailure
+		data["error"] = err.Error()
+		log.Error("job failed", "attempts", attempt, "duration_ms", duration.Milliseconds(), logger.FieldError, err)
+	} else {
+		result.Status = job.StatusSuccess
+		result.Summary = rep.summary
+		result.Report = rep.report
+		for key, value := range rep.summary {
+			data[key] = value
+		}
+		log.Info("job completed", "attempts", attempt, "duration_ms", duration.Milliseconds())
+	}
+	metrics.JobDuration.WithLabelValues(j.Name(), result.Status).Observe(duration.Seconds())
+
+	// Run record and events are saved even when ctx was canceled
+	finishCtx := trace.ContextWithSpan(logger.NewContext(context.Background(), log), span)
+	finishCtx, cancel := context.WithTimeout(finishCtx, time.Second*10)
+	defer cancel()
+	if err := job.StoreFinishRun(finishCtx, opts.RunID, result); err != nil {
+		log.Error("recording job run failed", logger.FieldError, err)
+	}
+	if err != nil {
+		r.publish(finishCtx, events.Event{Type: consts.EventJobFailed, CorrelationID: opts.RunID, Data: data})
+		return err
+	}
+	r.publish(finishCtx, events.Event{Type: consts.EventJobCompleted, CorrelationID: opts.RunID, Data: data})
+	for _, event := range rep.events {
+		r.publish(finishCtx, event)
+	}
+	return nil
+}
+
+// runAttempt runs the job once. Panic of the job is returned as an error.
+func runAttempt(ctx context.Context, j Job, rep *reporter, timeout time.Duration) (err error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			rep.log.Error("job panicked", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			err = fmt.Errorf("job panicked: %v", v)
+		}
+	}()
+	err = j.Run(logger.NewContext(ctx, rep.log), rep)
+	// Job might return some other error when it notices the timeout
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v: %w", timeout, err)
+	}
+	return err
+}
+
+// publish sends event and logs failures
+func (r *Runner) publish(ctx context.Context, event events.Event) {
+	if r.Channel == nil {
+		return
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if err := events.Publish(ctx, r.Channel, &event); err != nil {
+		logger.FromContext(ctx).Error("publishing event failed", "type", event.Type, logger.FieldError, err)
+	}
+}
+
+// reporter collects what job reported during one attempt
+type reporter struct {
+	runID   string
+	log     *logger.Logger
+	summary map[string]interface{}
+	report  interface{}
+	events  []events.Event
+}
+
+func newReporter(runID string, log *logger.Logger) *reporter {
+	return &reporter{runID: runID, log: log, summary: make(map[string]interface{})}
+}
+
+func (r *reporter) RunID() string {
+	return r.runID
+}
+
+func (r *reporter) Logger() *logger.Logger {
+	return r.log
+}
+
+func (r *reporter) Set(key string, value interface{}) {
+	r.summary[key] = value
+}
+
+func (r *reporter) SetReport(report interface{}) {
+	r.report = report
+}
+
+func (r *reporter) Publish(event events.Event) {
+	if event.CorrelationID == "" {
+		event.CorrelationID = r.runID
+	}
+	r.events = append(r.events, event)
+}
@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"miikka.xyz/devops-app/lib/job"
+	"miikka.xyz/devops-app/store"
+)
+
+// fakeJob fails until it has been run 'failures' times
+type fakeJob struct {
+	failures int
+	runs     int
+	block    bool
+	panics   bool
+}
+
+func (f *fakeJob) Name() string {
+	return "fake"
+}
+
+func (f *fakeJob) Run(ctx context.Context, reporter Reporter) error {
+	f.runs++
+	if f.panics {
+		panic("boom")
+	}
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.runs <= f.failures {
+		return errors.New("failed")
+	}
+	reporter.Set("runs", f.runs)
+	reporter.SetReport(map[string]string{"run_id": reporter.RunID()})
+	return nil
+}
+
+func TestRunner(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+	ctx := context.Background()
+	runner := &Runner{}
+
+	tt := []struct {
+		name     string
+		job      *fakeJob
+		opts     RunOptions
+		status   string
+		attempts int
+	}{
+		{"success", &fakeJob{}, RunOptions{}, job.StatusSuccess, 1},
+		{"retried", &fakeJob{failures: 2}, RunOptions{Retries: 2, RetryDelay: time.Millisecond}, job.StatusSuccess, 3},
+		{"retries run out", &fakeJob{failures: 5}, RunOptions{Retries: 1, RetryDelay: time.Millisecond}, job.StatusFailure, 2},
+		{"timeout", &fakeJob{block: true}, RunOptions{Timeout: time.Millisecond * 10}, job.StatusFailure, 1},
+		{"panic", &fakeJob{panics: true}, RunOptions{}, job.StatusFailure, 1},
+	}
+
+	for _, item := range tt {
+		item.opts.RunID = item.name
+		err := runner.Run(ctx, item.job, item.opts)
+		if (err == nil) != (item.status == job.StatusSuccess) {
+			t.Error(item.name, "unexpected error", err)
+		}
+
+		run, err := job.StoreGetRun(ctx, item.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run == nil || run.Status != item.status || run.Attempts != item.attempts || run.Job != "fake" {
+			t.Error(item.name, "wrong run record", run)
+			continue
+		}
+		if item.status == job.StatusSuccess && (run.Summary["runs"] == nil || run.Report["run_id"] != item.name) {
+			t.Error(item.name, "summary or report missing", run.Summary, run.Report)
+		}
+	}
+}
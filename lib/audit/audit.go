@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Actors that are not users
+const (
+	ActorAnonymous  = "anonymous"
+	ActorAdminToken = "admin_token"
+)
+
+type contextKey int
+
+const actorKey contextKey = iota
+
+// actor is who does actions of a request
+type actor struct {
+	ID   primitive.ObjectID
+	Name string
+}
+
+// WithActor names the actor of requests that have no user, like requests made with ADMIN_TOKEN
+func WithActor(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, actorKey, actor{Name: name})
+}
+
+// WithUser makes user the actor of the request. Server sets this for logged in users.
+func WithUser(ctx context.Context, id primitive.ObjectID, username string) context.Context {
+	return context.WithValue(ctx, actorKey, actor{ID: id, Name: username})
+}
+
+// ActorFromContext returns name of the request's actor
+func ActorFromContext(ctx context.Context) string {
+	if a, ok := ctx.Value(actorKey).(actor); ok {
+		return a.Name
+	}
+	return ActorAnonymous
+}
+
+// Record appends action of the request's actor to the audit log. Failures are
+// logged, an action is not undone because it could not be recorded.
+func Record(r *http.Request, action string, objectID primitive.ObjectID, data map[string]interface{}) {
+	entry := &Entry{
+		Actor:         ActorAnonymous,
+		ObjectID:      objectID,
+		Type:          action,
+		CorrelationID: logger.RequestID(r.Context()),
+		CreatedAt:     time.Now().UTC(),
+		Data:          data,
+	}
+	if a, ok := r.Context().Value(actorKey).(actor); ok {
+		entry.SubjectID = a.ID
+		entry.Actor = a.Name
+	}
+	entry.IP = utils.ClientIP(r)
+
+	// Request might be already canceled, entry is saved anyway
+	ctx, cancel := context.WithTimeout(logger.NewContext(context.Background(), logger.FromContext(r.Context())), time.Second*5)
+	defer cancel()
+	if err := StoreCreateEntry(ctx, entry); err != nil {
+		logger.FromContext(ctx).Error("recording audit entry failed", "action", action, logger.FieldError, err)
+	}
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+const dateLayout = "2006-01-02"
+
+// HandleListEntries godoc
+// @Summary List audit log
+// @Description Lists newest audit log entries. Times are RFC 3339 or dates, a date in 'to' includes the whole day.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param actor query string false "Username, admin_token or anonymous"
+// @Param action query string false "Action like user_created"
+// @Param from query string false "Start time, like 2021-12-01 or 2021-12-01T10:00:00Z"
+// @Param to query string false "End time, like 2021-12-31 or 2021-12-31T10:00:00Z"
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} audit.EntryListResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/audit [get]
+func HandleListEntries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pagination, err := utils.ParsePagination(query)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := ParseFilter(query)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	skip := int64((pagination.Page - 1) * pagination.PerPage)
+	entries, total, err := StoreGetEntries(ctx, filter, skip, int64(pagination.PerPage))
+	if err != nil {
+		logger.FromContext(ctx).Error("getting audit log failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	pagination.Total = int(total)
+
+	utils.WriteJSON(w, http.StatusOK, EntryListResponse{
+		Data: entries,
+		Meta: EntryListMeta{Pagination: pagination},
+	})
+}
+
+// ParseFilter reads 'actor', 'action', 'from' and 'to' query parameters
+func ParseFilter(query url.Values) (Filter, error) {
+	filter := Filter{
+		Actor:  strings.TrimSpace(query.Get("actor")),
+		Action: strings.TrimSpace(query.Get("action")),
+	}
+	var err error
+	if filter.From, err = parseTime(query.Get("from"), false); err != nil {
+		return Filter{}, fmt.Errorf("invalid 'from': %w", err)
+	}
+	if filter.To, err = parseTime(query.Get("to"), true); err != nil {
+		return Filter{}, fmt.Errorf("invalid 'to': %w", err)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return Filter{}, errors.New("'from' must be before 'to'")
+	}
+	return filter, nil
+}
+
+// parseTime parses RFC 3339 time or a date. End of range date means the end of that day.
+func parseTime(value string, end bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected format %s or %s", dateLayout, time.RFC3339)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Actions
+const (
+	ActionAccessDenied   = "access_denied"
+	ActionUserCreated    = "user_created"
+	ActionUserUpdated    = "user_updated"
+	ActionUserDeleted    = "user_deleted"
+	ActionRoleChanged    = "role_changed"
+	ActionTokenCreated   = "token_created"
+	ActionTokenRevoked   = "token_revoked"
+	ActionJobTriggered   = "job_triggered"
+	ActionCacheRefreshed = "cache_refreshed"
+	ActionWebhookCreated = "webhook_created"
+	ActionWebhookDeleted = "webhook_deleted"
+	// ActionWebhookReplayed is recorded when replay is requested
+	ActionWebhookReplayed = "webhook_replayed"
+)
+
+// Entry is one action in the audit log. Fields follow events.Event: subject
+// is the actor, object is the target and type is the action.
+type Entry struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	// SubjectID is ID of the user who did the action, empty for anonymous requests
+	SubjectID primitive.ObjectID `bson:"subject_id,omitempty" json:"actor_id,omitempty"`
+	// Actor is username, 'admin_token' or 'anonymous'
+	Actor    string             `bson:"actor" json:"actor"`
+	ObjectID primitive.ObjectID `bson:"object_id,omitempty" json:"object_id,omitempty"`
+	Type     string             `bson:"type" json:"action"`
+	// CorrelationID is ID of the request
+	CorrelationID string                 `bson:"correlation_id,omitempty" json:"request_id,omitempty"`
+	IP            string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	CreatedAt     time.Time              `bson:"created_at" json:"created_at"`
+	Data          map[string]interface{} `bson:"data,omitempty" json:"data,omitempty"`
+}
+
+// Filter selects entries of the audit log. Empty fields match everything.
+type Filter struct {
+	Actor  string
+	Action string
+	// From is inclusive and To exclusive
+	From time.Time
+	To   time.Time
+}
+
+// EntryListMeta is returned with list of entries
+type EntryListMeta struct {
+	Pagination utils.Pagination `json:"pagination"`
+}
+
+// EntryListResponse is response of 'GET /api/v1/admin/audit'
+type EntryListResponse struct {
+	Data []Entry       `json:"data"`
+	Meta EntryListMeta `json:"meta"`
+}
@@ -0,0 +1,61 @@
+package audit
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/store"
+)
+
+// StoreCreateEntry appends entry to the audit log. Entries are never updated or deleted.
+func StoreCreateEntry(ctx context.Context, entry *Entry) error {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAuditLog)
+	_, err := coll.InsertOne(ctx, entry)
+	return err
+}
+
+// StoreGetEntries returns newest entries matching filter and total count of them
+func StoreGetEntries(ctx context.Context, filter Filter, skip, limit int64) ([]Entry, int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAuditLog)
+
+	query := bson.M{}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Action != "" {
+		query["type"] = filter.Action
+	}
+	createdAt := bson.M{}
+	if !filter.From.IsZero() {
+		createdAt["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		createdAt["$lt"] = filter.To
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+
+	total, err := coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(limit)
+	cursor, err := coll.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]Entry, 0)
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/store"
+)
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter(url.Values{"actor": {"jack"}, "from": {"2021-12-01"}, "to": {"2021-12-01"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Actor != "jack" || filter.To.Sub(filter.From) != time.Hour*24 {
+		t.Error("wrong filter", filter)
+	}
+	filter, err = ParseFilter(url.Values{"from": {"2021-12-01T10:00:00+02:00"}})
+	if err != nil || !filter.From.Equal(time.Date(2021, 12, 1, 8, 0, 0, 0, time.UTC)) || !filter.To.IsZero() {
+		t.Error("wrong from", filter, err)
+	}
+	for _, query := range []url.Values{
+		{"from": {"01.12.2021"}},
+		{"to": {"yesterday"}},
+		{"from": {"2021-12-02"}, "to": {"2021-12-01"}},
+	} {
+		if _, err := ParseFilter(query); err == nil {
+			t.Error("expected error", query)
+		}
+	}
+}
+
+func TestRecordAndList(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+
+	userID := primitive.NewObjectID()
+	req := httptest.NewRequest("POST", "/api/v1/users", nil)
+	Record(req.WithContext(WithUser(req.Context(), userID, "jack")), ActionUserCreated, primitive.NewObjectID(), map[string]interface{}{"username": "chloe"})
+	Record(req.WithContext(WithActor(req.Context(), ActorAdminToken)), ActionJobTriggered, primitive.NilObjectID, nil)
+	Record(req, ActionAccessDenied, primitive.NilObjectID, nil)
+
+	entries, total, err := StoreGetEntries(context.Background(), Filter{Actor: "jack"}, 0, 10)
+	if err != nil || total != 1 {
+		t.Fatal("expected one entry of jack", total, err)
+	}
+	if entries[0].SubjectID != userID || entries[0].Type != ActionUserCreated || entries[0].IP == "" {
+		t.Error("wrong entry", entries[0])
+	}
+	if _, total, _ := StoreGetEntries(context.Background(), Filter{Action: ActionAccessDenied}, 0, 10); total != 1 {
+		t.Error("expected one denied entry, got", total)
+	}
+	if _, total, _ := StoreGetEntries(context.Background(), Filter{From: time.Now().Add(time.Hour)}, 0, 10); total != 0 {
+		t.Error("expected no entries in the future, got", total)
+	}
+
+	rr := httptest.NewRecorder()
+	HandleListEntries(rr, httptest.NewRequest("GET", "/api/v1/admin/audit?actor=admin_token&per_page=5", nil))
+	list := EntryListResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || rr.Code != http.StatusOK {
+		t.Fatal(rr.Code, rr.Body.String())
+	}
+	if len(list.Data) != 1 || list.Data[0].Type != ActionJobTriggered || list.Meta.Pagination.Total != 1 {
+		t.Error("wrong list", list)
+	}
+}
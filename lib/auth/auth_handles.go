@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/streadway/amqp"
+	"golang.org/x/crypto/bcrypt"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Password limits. Bcrypt uses only first 72 bytes.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+	bcryptCost        = 12
+)
+
+// errInvalidLogin doesn't tell whether username or password was wrong
+const errInvalidLogin = "invalid username or password"
+
+// dummyHash is compared when user is not found, so response time doesn't
+// reveal which usernames exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcryptCost)
+
+// Config holds sessions and cookie settings
+type Config struct {
+	Sessions   *Sessions
+	CookieName string
+	// CookieSecure sends cookie only over HTTPS
+	CookieSecure bool
+}
+
+// ConfigFromEnv reads SESSION_TTL and SESSION_COOKIE_SECURE
+func ConfigFromEnv(client redis.UniversalClient) *Config {
+	return &Config{
+		Sessions:     &Sessions{Client: client, TTL: utils.GetEnvDuration("SESSION_TTL", time.Hour*24*7)},
+		CookieName:   "session",
+		CookieSecure: utils.GetEnv("SESSION_COOKIE_SECURE", "true") == "true",
+	}
+}
+
+// HashPassword validates password and returns its bcrypt hash
+func HashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", errors.New("password must be 8-72 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	return string(hash), err
+}
+
+// CheckPassword tells if password matches the hash
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// HandleRegister godoc
+// @Summary Register
+// @Description Creates a user with password and logs in
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param user body auth.RegisterInput true "User"
+// @Success 201 {object} user.User
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 409 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/auth/register [post]
+func (c *Config) HandleRegister(ch *amqp.Channel) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		input := RegisterInput{}
+		if !utils.ReadJSON(w, r, &input) {
+			return
+		}
+		u, err := user.NewUser(user.UserInput{
+			Username:  input.Username,
+			FirstName: input.FirstName,
+			LastName:  input.LastName,
+		})
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		u.PasswordHash, err = HashPassword(input.Password)
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+		if !user.Create(ctx, w, ch, u) {
+			return
+		}
+		if err := c.startSession(ctx, w, r, u); err != nil {
+			logger.FromContext(ctx).Error("creating session failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "user was created but login failed")
+			return
+		}
+		logger.FromContext(ctx).Info("user registered", "user", u.Username)
+		// New user is the actor of their own registration
+		audit.Record(r.WithContext(audit.WithUser(r.Context(), u.ID, u.Username)), audit.ActionUserCreated, u.ID, map[string]interface{}{
+			"username": u.Username,
+			"role":     u.Role,
+		})
+		utils.WriteJSON(w, http.StatusCreated, u)
+	}
+}
+
+// HandleLogin godoc
+// @Summary Log in
+// @Description Sets session cookie
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param credentials body auth.LoginInput true "Credentials"
+// @Success 200 {object} user.User
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/auth/login [post]
+func (c *Config) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	input := LoginInput{}
+	if !utils.ReadJSON(w, r, &input) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+	log := logger.FromContext(ctx)
+
+	u, err := user.StoreGetUserByUsername(ctx, input.Username)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	if u == nil || u.PasswordHash == "" {
+		CheckPassword(string(dummyHash), input.Password)
+		log.Warn("login failed", "user", input.Username)
+		utils.WriteJSONError(w, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+	if !CheckPassword(u.PasswordHash, input.Password) || !u.IsActive {
+		log.Warn("login failed", "user", input.Username)
+		utils.WriteJSONError(w, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+
+	// Old session of this browser is replaced
+	if cookie, err := r.Cookie(c.CookieName); err == nil {
+		c.Sessions.Delete(ctx, cookie.Value)
+	}
+	if err := c.startSession(ctx, w, r, u); err != nil {
+		log.Error("creating session failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, "could not create session")
+		return
+	}
+	log.Info("user logged in", "user", u.Username)
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// HandleLogout godoc
+// @Summary Log out
+// @Description Removes session and its cookie
+// @Tags auth
+// @Success 204
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/auth/logout [post]
+func (c *Config) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(c.CookieName); err == nil {
+		if err := c.Sessions.Delete(r.Context(), cookie.Value); err != nil {
+			logger.FromContext(r.Context()).Error("deleting session failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not log out")
+			return
+		}
+	}
+	c.clearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMe godoc
+// @Summary Current user
+// @Tags auth
+// @Produce json
+// @Success 200 {object} user.User
+// @Failure 401 {object} utils.ErrorResponse
+// @Router /api/v1/auth/me [get]
+func HandleMe(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, UserFromContext(r.Context()))
+}
+
+// startSession creates session and sets its cookie
+func (c *Config) startSession(ctx context.Context, w http.ResponseWriter, r *http.Request, u *user.User) error {
+	id, err := c.Sessions.Create(ctx, &Session{
+		UserID:    u.ID,
+		CreatedAt: time.Now().UTC(),
+		UserAgent: r.UserAgent(),
+		IP:        utils.ClientIP(r),
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.CookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(c.Sessions.TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   c.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearCookie tells browser to remove session cookie
+func (c *Config) clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+type contextKey int
+
+const userKey contextKey = iota
+
+// NewContext returns context with the current user
+func NewContext(ctx context.Context, u *user.User) context.Context {
+	return context.WithValue(ctx, userKey, u)
+}
+
+// UserFromContext returns the current user or nil for anonymous requests
+func UserFromContext(ctx context.Context) *user.User {
+	u, _ := ctx.Value(userKey).(*user.User)
+	return u
+}
+
+// Middleware puts user of the session cookie to request context. Requests
+// without valid session continue as anonymous.
+func (c *Config) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(c.CookieName)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+		u, err := c.sessionUser(ctx, cookie.Value)
+		cancel()
+		// Public endpoints keep working when sessions can't be read
+		if err != nil {
+			logger.FromContext(r.Context()).Error("reading session failed", logger.FieldError, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u == nil {
+			// Expired session or deleted user
+			c.clearCookie(w)
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx = NewContext(r.Context(), u)
+		ctx = logger.NewContext(ctx, logger.FromContext(ctx).With("user", u.Username))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireUser responds 401 to anonymous requests
+func RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if UserFromContext(r.Context()) == nil {
+			utils.WriteJSONError(w, http.StatusUnauthorized, "login required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionUser returns active user of the session. Session is removed when
+// user is no longer active.
+func (c *Config) sessionUser(ctx context.Context, id string) (*user.User, error) {
+	session, err := c.Sessions.Get(ctx, id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	u, err := user.StoreGetUserByID(ctx, session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || !u.IsActive {
+		return nil, c.Sessions.Delete(ctx, id)
+	}
+	return u, nil
+}
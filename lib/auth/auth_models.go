@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RegisterInput is body of 'POST /api/v1/auth/register'
+type RegisterInput struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// LoginInput is body of 'POST /api/v1/auth/login'
+type LoginInput struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Session is saved to redis. Key is hash of the session ID that is sent in a cookie.
+type Session struct {
+	UserID    primitive.ObjectID `json:"user_id"`
+	CreatedAt time.Time          `json:"created_at"`
+	// UserAgent and IP are for recognizing sessions
+	UserAgent string `json:"user_agent,omitempty"`
+	IP        string `json:"ip,omitempty"`
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// sessionKeyPrefix is prefix of session keys in redis
+const sessionKeyPrefix = "session:"
+
+// Sessions stores sessions in redis. Sessions expire TTL after login, same as
+// their cookies.
+type Sessions struct {
+	Client redis.UniversalClient
+	TTL    time.Duration
+}
+
+// Create saves session and returns its ID
+func (s *Sessions) Create(ctx context.Context, session *Session) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(buf)
+
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Client.Set(ctx, sessionKey(id), value, s.TTL).Err(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Get returns session. Returns nil when session is not found.
+func (s *Sessions) Get(ctx context.Context, id string) (*Session, error) {
+	value, err := s.Client.Get(ctx, sessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	return session, json.Unmarshal(value, session)
+}
+
+// Delete removes session
+func (s *Sessions) Delete(ctx context.Context, id string) error {
+	return s.Client.Del(ctx, sessionKey(id)).Err()
+}
+
+// sessionKey hashes the ID, so IDs can't be read from redis
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return sessionKeyPrefix + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"miikka.xyz/devops-app/cache"
+	"miikka.xyz/devops-app/store"
+)
+
+func TestPassword(t *testing.T) {
+	if _, err := HashPassword("short"); err == nil {
+		t.Error("short password should fail")
+	}
+	if _, err := HashPassword(strings.Repeat("a", 73)); err == nil {
+		t.Error("too long password should fail")
+	}
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword(hash, "correct horse") || CheckPassword(hash, "wrong horse") {
+		t.Error("password check failed")
+	}
+}
+
+func TestSessionFlow(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+	cacheClient, cacheTeardown := cache.New(true)
+	defer cacheTeardown(context.Background())
+
+	config := &Config{
+		Sessions:   &Sessions{Client: cacheClient.UniversalClient, TTL: time.Minute},
+		CookieName: "session",
+	}
+	router := mux.NewRouter()
+	router.Use(config.Middleware)
+	router.HandleFunc("/register", config.HandleRegister(nil)).Methods("POST")
+	router.HandleFunc("/login", config.HandleLogin).Methods("POST")
+	router.HandleFunc("/logout", config.HandleLogout).Methods("POST")
+	router.Handle("/me", RequireUser(http.HandlerFunc(HandleMe))).Methods("GET")
+	do := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	sessionCookie := func(rr *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "session" && c.Value != "" {
+				return c
+			}
+		}
+		return nil
+	}
+
+	rr := do("POST", "/register", `{"username": "jack", "password": "short"}`, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Error("short password should fail", rr.Code)
+	}
+	rr = do("POST", "/register", `{"username": "jack", "password": "correct horse"}`, nil)
+	if rr.Code != http.StatusCreated || sessionCookie(rr) == nil {
+		t.Fatal("register failed", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "password") {
+		t.Error("password hash in response", rr.Body.String())
+	}
+	cookie := sessionCookie(rr)
+	if rr := do("GET", "/me", "", cookie); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"jack"`) {
+		t.Error("me failed", rr.Code, rr.Body.String())
+	}
+
+	if rr := do("POST", "/logout", "", cookie); rr.Code != http.StatusNoContent {
+		t.Error("logout failed", rr.Code)
+	}
+	if rr := do("GET", "/me", "", cookie); rr.Code != http.StatusUnauthorized {
+		t.Error("session should be removed", rr.Code)
+	}
+
+	if rr := do("POST", "/login", `{"username": "jack", "password": "wrong horse"}`, nil); rr.Code != http.StatusUnauthorized {
+		t.Error("wrong password should fail", rr.Code)
+	}
+	if rr := do("POST", "/login", `{"username": "nobody", "password": "correct horse"}`, nil); rr.Code != http.StatusUnauthorized {
+		t.Error("unknown user should fail", rr.Code)
+	}
+	rr = do("POST", "/login", `{"username": "jack", "password": "correct horse"}`, nil)
+	if rr.Code != http.StatusOK || sessionCookie(rr) == nil {
+		t.Fatal("login failed", rr.Code, rr.Body.String())
+	}
+	if rr := do("GET", "/me", "", sessionCookie(rr)); rr.Code != http.StatusOK {
+		t.Error("me after login failed", rr.Code)
+	}
+}
@@ -0,0 +1,206 @@
+package feed
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+const (
+	feedTitle = "miikka.xyz traffic"
+	// maxEntries is how many newest events are in a feed
+	maxEntries = 50
+)
+
+// feedTypes are event types that are published in feeds
+var feedTypes = []string{
+	consts.EventJobCompleted,
+	consts.EventJobFailed,
+	consts.EventTrafficJobCompleted,
+	consts.EventTrafficJobFailed,
+	consts.EventDailySummary,
+	consts.EventTrafficSpike,
+	consts.EventRepoAdded,
+	consts.EventRepoRemoved,
+}
+
+// HandleAtom serves newest events as Atom feed
+func HandleAtom(w http.ResponseWriter, r *http.Request) {
+	entries, ok := getEntries(w, r)
+	if !ok {
+		return
+	}
+
+	baseURL := PublicURL()
+	feed := atomFeed{
+		ID:    baseURL + "/feed.atom",
+		Title: feedTitle,
+		Links: []atomLink{
+			{Href: baseURL + "/feed.atom", Rel: "self"},
+			{Href: baseURL + "/"},
+		},
+		Author:  atomAuthor{Name: consts.GithubOwner},
+		Updated: lastUpdated(entries).Format(time.RFC3339),
+	}
+	for _, e := range entries {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      e.ID,
+			Title:   e.Title,
+			Updated: e.Updated.Format(time.RFC3339),
+			Link:    atomLink{Href: e.Link},
+			Summary: e.Summary,
+		})
+	}
+	writeXML(w, "application/atom+xml; charset=utf-8", feed)
+}
+
+// HandleRSS serves newest events as RSS 2.0 feed
+func HandleRSS(w http.ResponseWriter, r *http.Request) {
+	entries, ok := getEntries(w, r)
+	if !ok {
+		return
+	}
+
+	baseURL := PublicURL()
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         feedTitle,
+			Link:          baseURL + "/",
+			Description:   "Traffic job runs, daily summaries and notable events of GitHub repositories",
+			LastBuildDate: lastUpdated(entries).Format(time.RFC1123Z),
+		},
+	}
+	for _, e := range entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			GUID:        rssGUID{Value: e.ID},
+			Title:       e.Title,
+			Link:        e.Link,
+			Description: e.Summary,
+			PubDate:     e.Updated.Format(time.RFC1123Z),
+		})
+	}
+	writeXML(w, "application/rss+xml; charset=utf-8", feed)
+}
+
+// EntryFromEvent builds feed entry from event
+func EntryFromEvent(event events.Event, baseURL string) Entry {
+	entry := Entry{
+		ID:      fmt.Sprintf("urn:miikka-xyz:event:%s", event.ID.Hex()),
+		Link:    baseURL + "/",
+		Updated: event.CreatedAt,
+	}
+	data := event.Data
+
+	switch event.Type {
+	case consts.EventJobCompleted:
+		entry.Title = jobTitle(data["job"]) + " completed"
+		if repos, ok := data["repos"]; ok {
+			entry.Summary = fmt.Sprintf("Traffic of %v repositories fetched in %vms", repos, data["duration_ms"])
+		} else {
+			entry.Summary = fmt.Sprintf("Completed in %vms", data["duration_ms"])
+		}
+	case consts.EventJobFailed:
+		entry.Title = jobTitle(data["job"]) + " failed"
+		entry.Summary = fmt.Sprintf("Error after %v attempts: %v", data["attempts"], data["error"])
+	case consts.EventTrafficJobCompleted:
+		entry.Title = "Traffic job completed"
+		entry.Summary = fmt.Sprintf("Traffic of %v repositories fetched in %vms", data["repos"], data["duration_ms"])
+	case consts.EventTrafficJobFailed:
+		entry.Title = "Traffic job failed"
+		entry.Summary = fmt.Sprintf("Error: %v", data["error"])
+	case consts.EventDailySummary:
+		entry.Title = fmt.Sprintf("Daily summary %v", data["date"])
+		entry.Summary = fmt.Sprintf("%v views, %v unique visitors and %v clones. Most viewed was %v with %v views.",
+			data["views"], data["unique_views"], data["clones"], data["top_repo"], data["top_repo_views"])
+	case consts.EventTrafficSpike:
+		entry.Title = fmt.Sprintf("Traffic spike in %v", data["repo"])
+		entry.Summary = fmt.Sprintf("%v views on %v, average before was %.1f", data["views"], data["date"], toFloat(data["average"]))
+		entry.Link = fmt.Sprintf("%s/api/v1/repos/%v/traffic", baseURL, data["repo"])
+	case consts.EventRepoAdded:
+		entry.Title = fmt.Sprintf("New repository %v", data["repo"])
+		entry.Summary = fmt.Sprintf("Started tracking traffic of %v", data["repo"])
+	case consts.EventUserCreated:
+		entry.Title = fmt.Sprintf("New user %v", data["username"])
+	case consts.EventRepoRemoved:
+		entry.Title = fmt.Sprintf("Repository %v removed", data["repo"])
+		entry.Summary = fmt.Sprintf("%v is no longer found from GitHub", data["repo"])
+	default:
+		entry.Title = event.Type
+	}
+	return entry
+}
+
+// jobTitle returns readable name of a job
+func jobTitle(name interface{}) string {
+	if name == consts.JobGithubTraffic {
+		return "Traffic job"
+	}
+	return fmt.Sprintf("Job %v", name)
+}
+
+// getEntries reads events from database. Error response is written if reading fails.
+func getEntries(w http.ResponseWriter, r *http.Request) ([]Entry, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	list, err := events.StoreGetLatestEvents(ctx, feedTypes, maxEntries)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("getting events failed", logger.FieldError, err)
+		http.Error(w, consts.ErrDatabase, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	baseURL := PublicURL()
+	entries := make([]Entry, 0, len(list))
+	for _, event := range list {
+		entries = append(entries, EntryFromEvent(event, baseURL))
+	}
+	return entries, true
+}
+
+func writeXML(w http.ResponseWriter, contentType string, value interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(value); err != nil {
+		logger.Error("writing feed failed", logger.FieldError, err)
+	}
+}
+
+// lastUpdated returns time of the newest entry, entries are newest first
+func lastUpdated(entries []Entry) time.Time {
+	if len(entries) == 0 {
+		return time.Now()
+	}
+	return entries[0].Updated
+}
+
+// PublicURL is the address of the site used in links
+func PublicURL() string {
+	return utils.GetEnv("PUBLIC_URL", "https://miikka.xyz")
+}
+
+// toFloat converts numbers decoded from database to float
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+package feed
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+)
+
+func TestEntryFromEvent(t *testing.T) {
+	tt := []struct {
+		event events.Event
+		title string
+	}{
+		{events.Event{Type: consts.EventJobCompleted, Data: map[string]interface{}{"job": consts.JobGithubTraffic, "repos": 12, "duration_ms": 900}}, "Traffic job completed"},
+		{events.Event{Type: consts.EventJobFailed, Data: map[string]interface{}{"job": "cleanup", "attempts": 3, "error": "timeout"}}, "Job cleanup failed"},
+		{events.Event{Type: consts.EventTrafficJobCompleted, Data: map[string]interface{}{"repos": 12, "duration_ms": 900}}, "Traffic job completed"},
+		{events.Event{Type: consts.EventDailySummary, Data: map[string]interface{}{"date": "2021-11-20"}}, "Daily summary 2021-11-20"},
+		{events.Event{Type: consts.EventTrafficSpike, Data: map[string]interface{}{"repo": "example", "average": 2.5}}, "Traffic spike in example"},
+		{events.Event{Type: consts.EventRepoAdded, Data: map[string]interface{}{"repo": "example"}}, "New repository example"},
+		{events.Event{Type: consts.EventRepoRemoved, Data: map[string]interface{}{"repo": "example"}}, "Repository example removed"},
+		{events.Event{Type: consts.EventUserCreated, Data: map[string]interface{}{"username": "jack"}}, "New user jack"},
+	}
+
+	for _, item := range tt {
+		item.event.ID = primitive.NewObjectID()
+		item.event.CreatedAt = time.Now()
+		entry := EntryFromEvent(item.event, "https://example.com")
+		if entry.Title != item.title {
+			t.Error("wrong title", entry.Title)
+		}
+		if !strings.HasSuffix(entry.ID, item.event.ID.Hex()) {
+			t.Error("wrong id", entry.ID)
+		}
+		if entry.Summary == "" {
+			t.Error("empty summary with", item.event.Type)
+		}
+	}
+}
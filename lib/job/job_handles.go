@@ -0,0 +1,179 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// CacheRefresher recomputes cached traffic windows. Cache implements this.
+type CacheRefresher interface {
+	UpdateTrafficCache(ctx context.Context) error
+}
+
+// HandleTriggerTrafficJob godoc
+// @Summary Trigger traffic job
+// @Description Saves a pending run and publishes traffic_job_requested command. Events consumer runs the job, follow it with the returned run ID.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 202 {object} job.TriggerResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/jobs/traffic/runs [post]
+func HandleTriggerTrafficJob(ch *amqp.Channel) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := logger.NewID()
+		requestID := logger.RequestID(r.Context())
+		event := events.Event{
+			CreatedAt:     time.Now(),
+			Type:          consts.EventTrafficJobRequested,
+			CorrelationID: runID,
+			Data: map[string]interface{}{
+				"job":          consts.JobGithubTraffic,
+				"run_id":       runID,
+				"requested_by": requestID,
+			},
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		// Run is saved before the request, so it can be followed right away
+		run := &Run{
+			RunID:       runID,
+			Job:         consts.JobGithubTraffic,
+			Trigger:     TriggerAdmin,
+			Status:      StatusPending,
+			RequestedBy: requestID,
+			StartedAt:   time.Now(),
+		}
+		if err := StoreCreateRun(ctx, run); err != nil {
+			logger.FromContext(ctx).Error("saving job run failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+		if err := events.Publish(ctx, ch, &event); err != nil {
+			logger.FromContext(ctx).Error("publishing job request failed", logger.FieldError, err)
+			result := Result{Status: StatusFailure, Err: errors.New("could not request job")}
+			if err := StoreFinishRun(ctx, runID, result); err != nil {
+				logger.FromContext(ctx).Error("recording job run failed", logger.FieldError, err)
+			}
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not request job")
+			return
+		}
+		logger.FromContext(r.Context()).Info("traffic job requested", logger.FieldRunID, runID)
+		audit.Record(r, audit.ActionJobTriggered, primitive.NilObjectID, map[string]interface{}{
+			"job":    consts.JobGithubTraffic,
+			"run_id": runID,
+		})
+		utils.WriteJSON(w, http.StatusAccepted, TriggerResponse{RunID: runID, Status: StatusPending})
+	}
+}
+
+// HandleListRuns godoc
+// @Summary List job runs
+// @Description Lists newest job runs with status and duration
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param job query string false "Job name like github_traffic"
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} job.RunListResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/jobs/runs [get]
+func HandleListRuns(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pagination, err := utils.ParsePagination(query)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	skip := int64((pagination.Page - 1) * pagination.PerPage)
+	runs, total, err := StoreGetRuns(ctx, query.Get("job"), skip, int64(pagination.PerPage))
+	if err != nil {
+		logger.FromContext(ctx).Error("getting job runs failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	pagination.Total = int(total)
+
+	utils.WriteJSON(w, http.StatusOK, RunListResponse{
+		Data: runs,
+		Meta: RunListMeta{Pagination: pagination},
+	})
+}
+
+// HandleGetRun godoc
+// @Summary Get job run
+// @Description Returns one run with per repository report
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param run_id path string true "Run ID"
+// @Success 200 {object} job.Run
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/jobs/runs/{run_id} [get]
+func HandleGetRun(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	run, err := StoreGetRun(ctx, mux.Vars(r)["run_id"])
+	if err != nil {
+		logger.FromContext(ctx).Error("getting job run failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	if run == nil {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, run)
+}
+
+// HandleRefreshCache godoc
+// @Summary Refresh cache
+// @Description Recomputes every precomputed traffic window from database
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 200 {object} job.CacheRefreshResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/cache/refresh [post]
+func HandleRefreshCache(refresher CacheRefresher, windows []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+		defer cancel()
+
+		start := time.Now()
+		if err := refresher.UpdateTrafficCache(ctx); err != nil {
+			logger.FromContext(ctx).Error("refreshing cache failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not refresh cache")
+			return
+		}
+		audit.Record(r, audit.ActionCacheRefreshed, primitive.NilObjectID, map[string]interface{}{"windows": windows})
+		utils.WriteJSON(w, http.StatusOK, CacheRefreshResponse{
+			Windows:    windows,
+			DurationMs: time.Since(start).Milliseconds(),
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package job
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Run statuses
+const (
+	// StatusPending is a requested run that has not started yet
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
+
+// Triggers tell what started a run
+const (
+	TriggerCron     = "cron"
+	TriggerStartup  = "startup"
+	TriggerAdmin    = "admin"
+	TriggerSchedule = "schedule"
+)
+
+// Run is one run of a job. Runs are saved to job_runs collection.
+type Run struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	RunID   string             `bson:"run_id" json:"run_id"`
+	Job     string             `bson:"job" json:"job"`
+	Trigger string             `bson:"trigger" json:"trigger"`
+	Status  string             `bson:"status" json:"status"`
+	// RequestedBy is request ID of admin request that triggered the run
+	RequestedBy string     `bson:"requested_by,omitempty" json:"requested_by,omitempty"`
+	StartedAt   time.Time  `bson:"started_at" json:"started_at"`
+	FinishedAt  *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	DurationMs  int64      `bson:"duration_ms" json:"duration_ms"`
+	// Attempts is how many times the job was tried, retries included
+	Attempts int    `bson:"attempts" json:"attempts"`
+	Error    string `bson:"error,omitempty" json:"error,omitempty"`
+	// Summary holds a few numbers the job reported, also sent with completed event
+	Summary map[string]interface{} `bson:"summary,omitempty" json:"summary,omitempty"`
+	// Report is job specific details of the run. It is left out from lists.
+	Report map[string]interface{} `bson:"report,omitempty" json:"report,omitempty"`
+}
+
+// Result tells how a run ended
+type Result struct {
+	Status   string
+	Attempts int
+	Err      error
+	Summary  map[string]interface{}
+	// Report can be any value that can be saved to database
+	Report interface{}
+}
+
+// RunListMeta is returned with list of runs
+type RunListMeta struct {
+	Pagination utils.Pagination `json:"pagination"`
+}
+
+// RunListResponse is response of 'GET /api/v1/admin/jobs/runs'
+type RunListResponse struct {
+	Data []Run       `json:"data"`
+	Meta RunListMeta `json:"meta"`
+}
+
+// TriggerResponse is response of 'POST /api/v1/admin/jobs/traffic/runs'
+type TriggerResponse struct {
+	RunID  string `json:"run_id"`
+	Status string `json:"status"`
+}
+
+// CacheRefreshResponse is response of 'POST /api/v1/admin/cache/refresh'
+type CacheRefreshResponse struct {
+	Windows    []string `json:"windows"`
+	DurationMs int64    `json:"duration_ms"`
+}
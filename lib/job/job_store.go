@@ -0,0 +1,167 @@
+package job
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/store"
+)
+
+// StoreCreateRun saves a new run. Run ID is unique, so saving the same run
+// twice fails with a duplicate key error.
+func StoreCreateRun(ctx context.Context, run *Run) error {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+	_, err := coll.InsertOne(ctx, run)
+	return err
+}
+
+// StoreStartRun marks run running, creating it if it doesn't exist. Pending
+// runs and runs left running by an interrupted process are started again.
+// Returns false when the run has already finished.
+func StoreStartRun(ctx context.Context, run *Run) (bool, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+
+	filter := bson.M{
+		"run_id": run.RunID,
+		"status": bson.M{"$in": []string{StatusPending, StatusRunning}},
+	}
+	set := bson.M{
+		"job":        run.Job,
+		"trigger":    run.Trigger,
+		"status":     StatusRunning,
+		"started_at": run.StartedAt,
+		"attempts":   0,
+	}
+	if run.RequestedBy != "" {
+		set["requested_by"] = run.RequestedBy
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(ctx, filter, bson.M{"$set": set}, opts)
+	// Finished run doesn't match the filter, so upsert tries to insert it again
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StoreFinishRun sets result and duration of the run
+func StoreFinishRun(ctx context.Context, runID string, result Result) error {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+
+	run, err := StoreGetRun(ctx, runID)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		return mongo.ErrNoDocuments
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"status":      result.Status,
+		"attempts":    result.Attempts,
+		"finished_at": now,
+		"duration_ms": now.Sub(run.StartedAt).Milliseconds(),
+	}
+	if result.Err != nil {
+		set["error"] = result.Err.Error()
+	}
+	if len(result.Summary) > 0 {
+		set["summary"] = result.Summary
+	}
+	if result.Report != nil {
+		set["report"] = result.Report
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"run_id": runID}, bson.M{"$set": set})
+	return err
+}
+
+// StoreGetRun returns run by its run ID. Returns nil when run is not found.
+func StoreGetRun(ctx context.Context, runID string) (*Run, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+
+	res := coll.FindOne(ctx, bson.M{"run_id": runID})
+	err := res.Err()
+	// Not found "error". This needs to be handled seperatly
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{}
+	return run, res.Decode(run)
+}
+
+// StoreGetRuns returns newest runs without reports and total count of runs. All jobs if
+// jobName is empty.
+func StoreGetRuns(ctx context.Context, jobName string, skip, limit int64) ([]Run, int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+
+	filter := bson.M{}
+	if jobName != "" {
+		filter["job"] = jobName
+	}
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"started_at": -1}).
+		SetSkip(skip).
+		SetLimit(limit).
+		SetProjection(bson.M{"report": 0})
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	runs := make([]Run, 0)
+	if err := cursor.All(ctx, &runs); err != nil {
+		return nil, 0, err
+	}
+	return runs, total, nil
+}
+
+// StoreDeleteRunsBefore deletes runs started before t and returns count of deleted runs
+func StoreDeleteRunsBefore(ctx context.Context, t time.Time) (int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+	res, err := coll.DeleteMany(ctx, bson.M{"started_at": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// StoreFailStaleRuns marks runs that are still pending or running but were started
+// before t as failed. Those were left unfinished when a process died or the
+// request was never consumed.
+func StoreFailStaleRuns(ctx context.Context, t time.Time) (int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionJobRuns)
+	filter := bson.M{
+		"status":     bson.M{"$in": []string{StatusPending, StatusRunning}},
+		"started_at": bson.M{"$lt": t},
+	}
+	update := bson.M{"$set": bson.M{"status": StatusFailure, "error": "run did not finish"}}
+	res, err := coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
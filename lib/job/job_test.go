@@ -0,0 +1,100 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"miikka.xyz/devops-app/store"
+)
+
+type fakeRefresher struct {
+	err error
+}
+
+func (f fakeRefresher) UpdateTrafficCache(ctx context.Context) error {
+	return f.err
+}
+
+func TestHandleRefreshCache(t *testing.T) {
+	tt := []struct {
+		refresher fakeRefresher
+		status    int
+	}{
+		{fakeRefresher{}, http.StatusOK},
+		{fakeRefresher{err: errors.New("redis is down")}, http.StatusInternalServerError},
+	}
+
+	for _, item := range tt {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/cache/refresh", nil)
+		recorder := httptest.NewRecorder()
+		HandleRefreshCache(item.refresher, []string{"7d"})(recorder, req)
+		if recorder.Code != item.status {
+			t.Error("expected", item.status, "got", recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestStoreRuns(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+	ctx := context.Background()
+
+	run := &Run{RunID: "abc", Job: "github_traffic", Trigger: TriggerAdmin, Status: StatusRunning, StartedAt: time.Now()}
+	if err := StoreCreateRun(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	result := Result{
+		Status:   StatusSuccess,
+		Attempts: 1,
+		Summary:  map[string]interface{}{"repos": 1},
+		Report:   struct{ PerRepo []string }{PerRepo: []string{"example"}},
+	}
+	if err := StoreFinishRun(ctx, "abc", result); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := StoreGetRun(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Status != StatusSuccess || found.FinishedAt == nil || found.Report == nil || found.Attempts != 1 {
+		t.Fatal("run was not finished", found)
+	}
+
+	runs, total, err := StoreGetRuns(ctx, "", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(runs) != 1 || runs[0].Report != nil {
+		t.Error("list should have one run without report", total, runs)
+	}
+
+	// Finished run is not started again, pending one is
+	started, err := StoreStartRun(ctx, &Run{RunID: "abc", Job: "github_traffic", Trigger: TriggerAdmin, StartedAt: time.Now()})
+	if err != nil || started {
+		t.Error("finished run should not start", started, err)
+	}
+	pending := &Run{RunID: "def", Job: "github_traffic", Trigger: TriggerAdmin, Status: StatusPending, RequestedBy: "req", StartedAt: time.Now()}
+	if err := StoreCreateRun(ctx, pending); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreCreateRun(ctx, pending); err == nil {
+		t.Error("run ID should be unique")
+	}
+	started, err = StoreStartRun(ctx, &Run{RunID: "def", Job: "github_traffic", Trigger: TriggerAdmin, StartedAt: time.Now()})
+	if err != nil || !started {
+		t.Fatal("pending run should start", started, err)
+	}
+	if found, _ := StoreGetRun(ctx, "def"); found == nil || found.Status != StatusRunning || found.RequestedBy != "req" {
+		t.Error("pending run was not started", found)
+	}
+
+	missing, err := StoreGetRun(ctx, "missing")
+	if err != nil || missing != nil {
+		t.Error("missing run should be nil", missing, err)
+	}
+}
@@ -1,13 +1,172 @@
 package notification
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/streadway/amqp"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/feed"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
 )
 
-func HandleGetNotifications(ch *amqp.Channel) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "notifications not yet implemented\n", 500)
+// HandleGetNotifications godoc
+// @Summary List notifications
+// @Description Lists unread events of the current user, newest first. Pass next_cursor of the response as cursor to get the next page.
+// @Tags notifications
+// @Produce json
+// @Param cursor query string false "Cursor from previous page"
+// @Param limit query int false "Items per page, max 100"
+// @Success 200 {object} notification.ListResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/notifications [get]
+func HandleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLimit {
+			utils.WriteJSONError(w, http.StatusBadRequest, "invalid 'limit'")
+			return
+		}
+	}
+	var before primitive.ObjectID
+	if value := query.Get("cursor"); value != "" {
+		var err error
+		before, err = primitive.ObjectIDFromHex(value)
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, "invalid 'cursor'")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+	u := auth.UserFromContext(ctx)
+
+	// One extra tells if there is a next page
+	list, err := StoreGetUnread(ctx, u, before, int64(limit+1))
+	if err != nil {
+		logger.FromContext(ctx).Error("getting notifications failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	unread, err := StoreCountUnread(ctx, u)
+	if err != nil {
+		logger.FromContext(ctx).Error("counting notifications failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+
+	response := ListResponse{
+		Data: make([]Notification, 0, len(list)),
+		Meta: ListMeta{Unread: unread},
+	}
+	if len(list) > limit {
+		list = list[:limit]
+		response.Meta.NextCursor = list[limit-1].ID.Hex()
+	}
+	for _, event := range list {
+		response.Data = append(response.Data, FromEvent(event))
+	}
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// HandleCountUnread godoc
+// @Summary Count unread notifications
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} notification.CountResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/notifications/count [get]
+func HandleCountUnread(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	unread, err := StoreCountUnread(ctx, auth.UserFromContext(ctx))
+	if err != nil {
+		logger.FromContext(ctx).Error("counting notifications failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, CountResponse{Unread: unread})
+}
+
+// HandleAck godoc
+// @Summary Acknowledge notification
+// @Tags notifications
+// @Param id path string true "Notification ID"
+// @Success 204
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/notifications/{id}/ack [post]
+func HandleAck(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, consts.ErrInvalidID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	found, err := StoreAck(ctx, auth.UserFromContext(ctx), id)
+	if err != nil {
+		logger.FromContext(ctx).Error("acknowledging notification failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	// Already acknowledged or not a notification of the user
+	if !found {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAckAll godoc
+// @Summary Acknowledge all notifications
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} notification.AckResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/notifications/ack [post]
+func HandleAckAll(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	count, err := StoreAckAll(ctx, auth.UserFromContext(ctx))
+	if err != nil {
+		logger.FromContext(ctx).Error("acknowledging notifications failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, AckResponse{Acknowledged: count})
+}
+
+// FromEvent builds notification from event with the same title and summary as feeds
+func FromEvent(event events.Event) Notification {
+	entry := feed.EntryFromEvent(event, "")
+	return Notification{
+		ID:        event.ID,
+		Type:      event.Type,
+		Title:     entry.Title,
+		Summary:   entry.Summary,
+		Link:      entry.Link,
+		CreatedAt: event.CreatedAt,
+		Data:      event.Data,
 	}
 }
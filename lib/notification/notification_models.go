@@ -0,0 +1,121 @@
+package notification
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/user"
+)
+
+// Paging limits
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+// trafficTypes are notified to every user
+var trafficTypes = []string{
+	consts.EventDailySummary,
+	consts.EventTrafficSpike,
+	consts.EventRepoAdded,
+	consts.EventRepoRemoved,
+}
+
+// jobTypes are notified to users who can run jobs
+var jobTypes = []string{
+	consts.EventJobCompleted,
+	consts.EventJobFailed,
+	consts.EventTrafficJobCompleted,
+	consts.EventTrafficJobFailed,
+}
+
+// anonymousTypes are streamed to clients without a user. They are not
+// notifications, so these don't change what users are notified of.
+var anonymousTypes = []string{
+	consts.EventDailySummary,
+	consts.EventTrafficSpike,
+	consts.EventRepoAdded,
+	consts.EventRepoRemoved,
+	consts.EventJobCompleted,
+	consts.EventTrafficJobCompleted,
+}
+
+// eventTypes returns event types that users with role are notified of. Events
+// with the user as object are notified regardless of type. Empty role is
+// anonymous.
+func eventTypes(role string) []string {
+	if role == "" {
+		return anonymousTypes
+	}
+	types := append([]string{}, trafficTypes...)
+	switch role {
+	case user.RoleMaintainer:
+		types = append(types, jobTypes...)
+	case user.RoleAdmin:
+		types = append(types, jobTypes...)
+		types = append(types, consts.EventUserCreated)
+	}
+	return types
+}
+
+// roleOf returns role of u. Users saved before roles are viewers.
+func roleOf(u *user.User) string {
+	if u.Role == "" {
+		return user.RoleViewer
+	}
+	return u.Role
+}
+
+// Relevant tells if u is notified of event. Nil u is anonymous.
+func Relevant(u *user.User, event events.Event) bool {
+	role := ""
+	if u != nil {
+		if event.ObjectID == u.ID {
+			return true
+		}
+		role = roleOf(u)
+	}
+	for _, t := range eventTypes(role) {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification is an unread event
+type Notification struct {
+	ID        primitive.ObjectID     `json:"id"`
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Summary   string                 `json:"summary,omitempty"`
+	Link      string                 `json:"link"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// ListMeta is returned with notifications
+type ListMeta struct {
+	// Unread is count of all unread notifications
+	Unread int64 `json:"unread"`
+	// NextCursor gets the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListResponse is response of 'GET /api/v1/notifications'
+type ListResponse struct {
+	Data []Notification `json:"data"`
+	Meta ListMeta       `json:"meta"`
+}
+
+// CountResponse is response of 'GET /api/v1/notifications/count'
+type CountResponse struct {
+	Unread int64 `json:"unread"`
+}
+
+// AckResponse is response of 'POST /api/v1/notifications/ack'
+type AckResponse struct {
+	Acknowledged int64 `json:"acknowledged"`
+}
@@ -0,0 +1,122 @@
+package notification
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/store"
+)
+
+// relevantFilter matches events that u is notified of, see Relevant
+func relevantFilter(u *user.User) bson.M {
+	if u == nil {
+		return bson.M{"type": bson.M{"$in": eventTypes("")}}
+	}
+	return bson.M{
+		"$or": bson.A{
+			bson.M{"object_id": u.ID},
+			bson.M{"type": bson.M{"$in": eventTypes(roleOf(u))}},
+		},
+	}
+}
+
+// unreadFilter matches events that u is notified of and hasn't acknowledged.
+// Events from before the user was created are skipped.
+func unreadFilter(u *user.User) bson.M {
+	filter := relevantFilter(u)
+	filter["ackd"] = bson.M{"$ne": u.ID}
+	filter["created_at"] = bson.M{"$gte": u.CreatedAt}
+	return filter
+}
+
+// appendAck adds userID to ackd. Older events have null ackd, so it's replaced with an array.
+func appendAck(userID primitive.ObjectID) mongo.Pipeline {
+	return mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"ackd": bson.M{"$concatArrays": bson.A{
+			bson.M{"$ifNull": bson.A{"$ackd", bson.A{}}},
+			bson.A{userID},
+		}},
+	}}}}
+}
+
+// StoreGetUnread returns newest unread events of u older than before. All if before is nil ID.
+func StoreGetUnread(ctx context.Context, u *user.User, before primitive.ObjectID, limit int64) ([]events.Event, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
+
+	filter := unreadFilter(u)
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit)
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]events.Event, 0)
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// StoreGetAfter returns oldest events relevant to u that were stored after
+// event with ID after. Nil u is anonymous.
+func StoreGetAfter(ctx context.Context, u *user.User, after primitive.ObjectID, limit int64) ([]events.Event, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
+
+	filter := relevantFilter(u)
+	filter["_id"] = bson.M{"$gt": after}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit)
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]events.Event, 0)
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// StoreCountUnread returns count of unread events of u
+func StoreCountUnread(ctx context.Context, u *user.User) (int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
+	return coll.CountDocuments(ctx, unreadFilter(u))
+}
+
+// StoreAck acknowledges one event for u. Returns false if the event is not an unread notification of u.
+func StoreAck(ctx context.Context, u *user.User, id primitive.ObjectID) (bool, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
+
+	filter := unreadFilter(u)
+	filter["_id"] = id
+	res, err := coll.UpdateOne(ctx, filter, appendAck(u.ID))
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// StoreAckAll acknowledges every unread event of u and returns count of them
+func StoreAckAll(ctx context.Context, u *user.User) (int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionEvents)
+
+	res, err := coll.UpdateMany(ctx, unreadFilter(u), appendAck(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
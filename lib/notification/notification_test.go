@@ -0,0 +1,118 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/store"
+)
+
+func TestNotifications(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+	ctx := context.Background()
+
+	viewer := &user.User{ID: primitive.NewObjectID(), Username: "chloe", Role: user.RoleViewer, CreatedAt: time.Now().Add(-time.Hour)}
+	maintainer := &user.User{ID: primitive.NewObjectID(), Username: "jack", Role: user.RoleMaintainer, CreatedAt: viewer.CreatedAt}
+
+	create := func(event events.Event) {
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = time.Now()
+		}
+		if _, err := events.StoreCreateEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		create(events.Event{Type: consts.EventTrafficSpike, Data: map[string]interface{}{"repo": fmt.Sprint("repo", i)}})
+	}
+	create(events.Event{Type: consts.EventJobFailed, Data: map[string]interface{}{"job": consts.JobGithubTraffic}})
+	// Shaped like the event published when a user is created
+	create(user.CreatedEvent(viewer, ""))
+	// Before the users existed
+	create(events.Event{Type: consts.EventRepoAdded, CreatedAt: time.Now().Add(-time.Hour * 2)})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/notifications", HandleGetNotifications).Methods("GET")
+	router.HandleFunc("/notifications/ack", HandleAckAll).Methods("POST")
+	router.HandleFunc("/notifications/{id}/ack", HandleAck).Methods("POST")
+	do := func(u *user.User, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req.WithContext(auth.NewContext(req.Context(), u)))
+		return rr
+	}
+	list := func(u *user.User, path string) ListResponse {
+		rr := do(u, "GET", path)
+		response := ListResponse{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+			t.Fatal(rr.Code, rr.Body.String())
+		}
+		return response
+	}
+
+	// Viewer gets spikes and the event about themselves, not job failures
+	page := list(viewer, "/notifications?limit=3")
+	if page.Meta.Unread != 4 || len(page.Data) != 3 || page.Meta.NextCursor == "" {
+		t.Fatal("wrong first page", page.Meta, len(page.Data))
+	}
+	if page.Data[0].Type != consts.EventUserCreated || page.Data[1].Title != "Traffic spike in repo2" {
+		t.Error("wrong order", page.Data)
+	}
+	last := list(viewer, "/notifications?limit=3&cursor="+page.Meta.NextCursor)
+	if len(last.Data) != 1 || last.Meta.NextCursor != "" || last.Data[0].Title != "Traffic spike in repo0" {
+		t.Error("wrong last page", last)
+	}
+	if count, _ := StoreCountUnread(ctx, maintainer); count != 4 {
+		t.Error("maintainer should have spikes and job failure, got", count)
+	}
+
+	// Acknowledging is per user
+	if rr := do(viewer, "POST", "/notifications/"+page.Data[1].ID.Hex()+"/ack"); rr.Code != http.StatusNoContent {
+		t.Fatal("ack failed", rr.Code, rr.Body.String())
+	}
+	if rr := do(viewer, "POST", "/notifications/"+page.Data[1].ID.Hex()+"/ack"); rr.Code != http.StatusNotFound {
+		t.Error("second ack should be not found", rr.Code)
+	}
+	if count, _ := StoreCountUnread(ctx, viewer); count != 3 {
+		t.Error("expected 3 unread, got", count)
+	}
+	if count, _ := StoreCountUnread(ctx, maintainer); count != 4 {
+		t.Error("ack of viewer changed maintainer, got", count)
+	}
+
+	rr := do(viewer, "POST", "/notifications/ack")
+	if rr.Code != http.StatusOK || rr.Body.String() != "{\"acknowledged\":3}\n" {
+		t.Error("ack all failed", rr.Code, rr.Body.String())
+	}
+	if page := list(viewer, "/notifications"); page.Meta.Unread != 0 || len(page.Data) != 0 {
+		t.Error("expected no notifications", page)
+	}
+
+	// Streams resume from any event, acknowledged or not
+	missed, err := StoreGetAfter(ctx, nil, page.Data[1].ID, 10)
+	if err != nil || len(missed) != 1 || missed[0].Type != consts.EventRepoAdded {
+		t.Error("anonymous should get only repo event after spike", missed, err)
+	}
+	missed, _ = StoreGetAfter(ctx, viewer, page.Data[2].ID, 10)
+	if len(missed) != 3 || missed[0].Type != consts.EventTrafficSpike || missed[1].Type != consts.EventUserCreated {
+		t.Error("wrong missed events of viewer", missed)
+	}
+
+	for _, path := range []string{"/notifications?limit=0", "/notifications?cursor=abc"} {
+		if rr := do(viewer, "GET", path); rr.Code != http.StatusBadRequest {
+			t.Error(path, "expected bad request, got", rr.Code)
+		}
+	}
+}
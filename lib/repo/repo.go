@@ -3,11 +3,13 @@ package repo
 import (
 	"context"
 	"encoding/json"
-	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/logger"
 	"miikka.xyz/devops-app/store"
 )
 
@@ -15,19 +17,23 @@ type TrafficData struct {
 	RepositoryName string    `bson:"name" json:"name"`
 	Views          int       `bson:"views" json:"views"`
 	UniqueViews    int       `bson:"unique_views" json:"unique_views"`
+	Clones         int       `bson:"clones" json:"clones"`
+	UniqueClones   int       `bson:"unique_clones" json:"unique_clones"`
 	Timestamp      time.Time `bson:"timestamp" json:"timestamp"`
 	// $lookup
 	RepositoryData RepositoryData `bson:"_meta" json:"_meta"`
 }
 
 type RepositoryData struct {
-	URL string `bson:"url" json:"url"`
+	Name string `bson:"name" json:"name"`
+	URL  string `bson:"url" json:"url"`
 }
 
 // ReposByNameMap type will be saved to Redis
 type ReposByNameMap map[string][]TrafficData
 
-// MarshalBinary implements Marshaler interface so this type can be saved to Redis
+// MarshalBinary implements Marshaler interface so this type can be saved to Redis.
+// Cache package writes values through its codecs, this is plain JSON without header.
 func (r ReposByNameMap) MarshalBinary() (data []byte, err error) {
 	data, err = json.Marshal(r)
 	return data, err
@@ -39,25 +45,26 @@ func StoreGetRepositoryTraffic(ctx context.Context, since time.Time) ([]TrafficD
 
 	cursor, err := coll.Find(ctx, bson.M{"timestamp": bson.M{"$gte": since}})
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("finding traffic failed", logger.FieldError, err)
 		return nil, err
 	}
 
 	var repos []TrafficData
 	err = cursor.All(ctx, &repos)
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("decoding traffic failed", logger.FieldError, err)
 		return nil, err
 	}
 	return repos, nil
 }
 
-func StoreGetRepositoryTrafficWithMeta(ctx context.Context, since time.Time) ([]TrafficData, error) {
+// StoreGetRepositoryTrafficWithMeta returns traffic data between 'from' and 'to' joined with repository data
+func StoreGetRepositoryTrafficWithMeta(ctx context.Context, from time.Time, to time.Time) ([]TrafficData, error) {
 	client := store.GetClient()
 	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionRepoTraffic)
 
 	pipe := make([]bson.M, 0)
-	match := bson.M{"$match": bson.M{"timestamp": bson.M{"$gte": since}}}
+	match := bson.M{"$match": bson.M{"timestamp": bson.M{"$gte": from, "$lte": to}}}
 	lookup := bson.M{"$lookup": bson.M{
 		"from":         consts.CollectionRepos,
 		"localField":   "name",
@@ -85,6 +92,44 @@ func StoreGetRepositoryTrafficWithMeta(ctx context.Context, since time.Time) ([]
 	return repos, nil
 }
 
+// StoreGetRepositories returns data of all repositories sorted by name. Removed repositories are skipped.
+func StoreGetRepositories(ctx context.Context) ([]RepositoryData, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionRepos)
+
+	filter := bson.M{"removed_at": bson.M{"$exists": false}}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]RepositoryData, 0)
+	err = cursor.All(ctx, &repos)
+	if err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// StoreGetRepositoryByName returns nil without error if repository is not found
+func StoreGetRepositoryByName(ctx context.Context, name string) (*RepositoryData, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionRepos)
+
+	res := coll.FindOne(ctx, bson.M{"name": name})
+	err := res.Err()
+	// Not found "error". This needs to be handled seperatly
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &RepositoryData{}
+	return repo, res.Decode(repo)
+}
+
 func FormatRepositorysToMap(repos []TrafficData) ReposByNameMap {
 	reposByName := make(ReposByNameMap)
 	for _, r := range repos {
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"miikka.xyz/devops-app/utils"
+)
+
+// Chart sizes in pixels
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 24
+	barChartWidth   = 360
+	barChartHeight  = 80
+)
+
+// TemplateSparkline renders inline SVG line of daily views
+func TemplateSparkline(traffic []TrafficData) template.HTML {
+	days := dailySeries(traffic)
+	if len(days) == 0 {
+		return ""
+	}
+	max := maxViews(days)
+
+	points := make([]string, 0, len(days))
+	for i, day := range days {
+		x := 0.0
+		if len(days) > 1 {
+			x = float64(i) * sparklineWidth / float64(len(days)-1)
+		}
+		y := sparklineHeight - 1 - float64(day.Views)*(sparklineHeight-2)/float64(max)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+
+	svg := fmt.Sprintf(`<svg class="sparkline" xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="views">`+
+		`<polyline fill="none" stroke="#007ec6" stroke-width="1.5" points="%s"/></svg>`,
+		sparklineWidth, sparklineHeight, sparklineWidth, sparklineHeight, strings.Join(points, " "))
+	return template.HTML(svg)
+}
+
+// TemplateBarChart renders inline SVG bar chart with views and unique views per day
+func TemplateBarChart(traffic []TrafficData) template.HTML {
+	days := dailySeries(traffic)
+	if len(days) == 0 {
+		return ""
+	}
+	max := maxViews(days)
+	barWidth := float64(barChartWidth) / float64(len(days))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="bar-chart" xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="daily views">`,
+		barChartWidth, barChartHeight, barChartWidth, barChartHeight)
+	for i, day := range days {
+		x := float64(i) * barWidth
+		viewsHeight := float64(day.Views) * barChartHeight / float64(max)
+		uniquesHeight := float64(day.UniqueViews) * barChartHeight / float64(max)
+		title := template.HTMLEscapeString(fmt.Sprintf("%s: %d views, %d unique", utils.DateToEuropean(day.Timestamp), day.Views, day.UniqueViews))
+		fmt.Fprintf(&b, `<g><title>%s</title>`, title)
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#9ecae1"/>`, x, barChartHeight-viewsHeight, barWidth*0.9, viewsHeight)
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#3182bd"/>`, x, barChartHeight-uniquesHeight, barWidth*0.9, uniquesHeight)
+		b.WriteString(`</g>`)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// TemplateTotals returns summed traffic of a repository
+func TemplateTotals(traffic []TrafficData) Totals {
+	return Sum(traffic)
+}
+
+// dailySeries returns traffic oldest first. Missing days between first and last
+// day are filled with zeros so charts have correct time scale.
+func dailySeries(traffic []TrafficData) []TrafficData {
+	if len(traffic) == 0 {
+		return nil
+	}
+	byDay := make(map[time.Time]TrafficData, len(traffic))
+	for _, t := range traffic {
+		day := t.Timestamp.UTC().Truncate(time.Hour * 24)
+		existing := byDay[day]
+		existing.Timestamp = day
+		existing.Views += t.Views
+		existing.UniqueViews += t.UniqueViews
+		existing.Clones += t.Clones
+		existing.UniqueClones += t.UniqueClones
+		byDay[day] = existing
+	}
+
+	days := make([]time.Time, 0, len(byDay))
+	for day := range byDay {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	series := make([]TrafficData, 0, len(days))
+	for day := days[0]; !day.After(days[len(days)-1]); day = day.AddDate(0, 0, 1) {
+		t, found := byDay[day]
+		if !found {
+			t = TrafficData{Timestamp: day}
+		}
+		series = append(series, t)
+	}
+	return series
+}
+
+// maxViews is never zero so it can be used as a divider
+func maxViews(days []TrafficData) int {
+	max := 1
+	for _, day := range days {
+		if day.Views > max {
+			max = day.Views
+		}
+	}
+	return max
+}
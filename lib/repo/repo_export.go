@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/store"
+)
+
+// Export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// ExportFilter limits exported rows
+type ExportFilter struct {
+	// Repos are repository names, empty means all
+	Repos []string
+	Range TrafficRange
+}
+
+// ExportRow is one exported traffic row joined with repository data
+type ExportRow struct {
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Timestamp    time.Time `json:"timestamp"`
+	Views        int       `json:"views"`
+	UniqueViews  int       `json:"unique_views"`
+	Clones       int       `json:"clones"`
+	UniqueClones int       `json:"unique_clones"`
+}
+
+// ExportWriter writes rows in some format
+type ExportWriter interface {
+	Write(row ExportRow) error
+	Flush() error
+}
+
+// NewExportWriter returns writer for csv or ndjson format
+func NewExportWriter(format string, w io.Writer) (ExportWriter, error) {
+	switch format {
+	case ExportCSV:
+		return newCSVWriter(w)
+	case ExportNDJSON:
+		return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown export format '%s'", format)
+}
+
+// ContentType returns MIME type of export format
+func ContentType(format string) string {
+	if format == ExportCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// ExportFilename returns filename like 'traffic-2021-11-01-2021-11-30.csv'
+func ExportFilename(format string, r TrafficRange) string {
+	return fmt.Sprintf("traffic-%s-%s.%s", r.From.Format(dateLayout), r.To.Format(dateLayout), format)
+}
+
+// ParseRepoFilter reads repository names from 'repo' query parameters. Both
+// '?repo=a&repo=b' and '?repo=a,b' work.
+func ParseRepoFilter(query url.Values) []string {
+	repos := make([]string, 0)
+	for _, value := range query["repo"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				repos = append(repos, name)
+			}
+		}
+	}
+	return repos
+}
+
+// StoreStreamTrafficWithMeta reads traffic rows joined with repository data from cursor
+// one by one and calls fn for each, so whole result is never loaded into memory
+func StoreStreamTrafficWithMeta(ctx context.Context, filter ExportFilter, fn func(row ExportRow) error) error {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionRepoTraffic)
+
+	match := bson.M{"timestamp": bson.M{"$gte": filter.Range.From, "$lte": filter.Range.To}}
+	if len(filter.Repos) > 0 {
+		match["name"] = bson.M{"$in": filter.Repos}
+	}
+	pipe := []bson.M{
+		{"$match": match},
+		{"$sort": bson.M{"name": 1, "timestamp": 1}},
+		{"$lookup": bson.M{
+			"from":         consts.CollectionRepos,
+			"localField":   "name",
+			"foreignField": "name",
+			"as":           "_meta",
+		}},
+		// Keep rows even if repository data is missing
+		{"$unwind": bson.M{"path": "$_meta", "preserveNullAndEmptyArrays": true}},
+	}
+
+	// Index of name and timestamp serves the sort. Disk is allowed in case the
+	// planner sorts in memory anyway, the 100MB limit would truncate the export.
+	cursor, err := coll.Aggregate(ctx, pipe, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var traffic TrafficData
+		if err := cursor.Decode(&traffic); err != nil {
+			return err
+		}
+		err := fn(ExportRow{
+			Name:         traffic.RepositoryName,
+			URL:          traffic.RepositoryData.URL,
+			Timestamp:    traffic.Timestamp,
+			Views:        traffic.Views,
+			UniqueViews:  traffic.UniqueViews,
+			Clones:       traffic.Clones,
+			UniqueClones: traffic.UniqueClones,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	writer := &csvWriter{w: csv.NewWriter(w)}
+	err := writer.w.Write([]string{"name", "url", "date", "views", "unique_views", "clones", "unique_clones"})
+	return writer, err
+}
+
+func (c *csvWriter) Write(row ExportRow) error {
+	return c.w.Write([]string{
+		row.Name,
+		row.URL,
+		row.Timestamp.Format(dateLayout),
+		strconv.Itoa(row.Views),
+		strconv.Itoa(row.UniqueViews),
+		strconv.Itoa(row.Clones),
+		strconv.Itoa(row.UniqueClones),
+	})
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+// Write writes one JSON object per line, Encode adds the newline
+func (n *ndjsonWriter) Write(row ExportRow) error {
+	return n.enc.Encode(row)
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return nil
+}
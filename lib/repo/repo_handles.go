@@ -0,0 +1,302 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// TrafficSource returns traffic data of a range. Cache implements this.
+type TrafficSource interface {
+	GetTrafficData(ctx context.Context, trafficRange TrafficRange) (ReposByNameMap, error)
+}
+
+// ListMeta is returned with every list response
+type ListMeta struct {
+	Range      TrafficRange     `json:"range"`
+	Pagination utils.Pagination `json:"pagination"`
+}
+
+// RepositoryListResponse is response of 'GET /api/v1/repos'
+type RepositoryListResponse struct {
+	Data []RepositorySummary `json:"data"`
+	Meta ListMeta            `json:"meta"`
+}
+
+// RepositoryTrafficResponse is response of 'GET /api/v1/repos/{name}/traffic'
+type RepositoryTrafficResponse struct {
+	Repository RepositoryData `json:"repository"`
+	Totals     Totals         `json:"totals"`
+	Data       []TrafficData  `json:"data"`
+	Meta       ListMeta       `json:"meta"`
+}
+
+// TrafficTotalsResponse is response of 'GET /api/v1/traffic/totals'
+type TrafficTotalsResponse struct {
+	Totals       Totals       `json:"totals"`
+	Repositories int          `json:"repositories"`
+	Data         []DailyTotal `json:"data"`
+	Meta         ListMeta     `json:"meta"`
+}
+
+// HandleListRepos godoc
+// @Summary List repositories
+// @Description Lists repositories with metadata and traffic totals of the range
+// @Tags repos
+// @Produce json
+// @Param range query string false "Range like 7d, 30d, 90d or custom"
+// @Param from query string false "Start date of custom range, YYYY-MM-DD"
+// @Param to query string false "End date of custom range, YYYY-MM-DD"
+// @Param sort query string false "name, views, unique_views or clones. Prefix with - for descending order"
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} repo.RepositoryListResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/repos [get]
+func HandleListRepos(source TrafficSource, defaultWindow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		trafficRange, pagination, ok := parseListQuery(w, r, defaultWindow)
+		if !ok {
+			return
+		}
+		field, desc, err := utils.ParseSort(query, "name", "name", "views", "unique_views", "clones")
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		repos, err := StoreGetRepositories(ctx)
+		if err != nil {
+			logger.FromContext(ctx).Error("getting repositories failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+		traffic, err := source.GetTrafficData(ctx, trafficRange)
+		if err != nil {
+			logger.FromContext(ctx).Error("getting traffic data failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+
+		summaries := Summaries(repos, traffic)
+		SortSummaries(summaries, field, desc)
+		from, to := pagination.Bounds(len(summaries))
+
+		utils.WriteJSON(w, http.StatusOK, RepositoryListResponse{
+			Data: summaries[from:to],
+			Meta: ListMeta{Range: trafficRange, Pagination: pagination},
+		})
+	}
+}
+
+// HandleGetRepoTraffic godoc
+// @Summary Daily traffic of a repository
+// @Description Returns daily views and unique views of one repository
+// @Tags repos
+// @Produce json
+// @Param name path string true "Repository name"
+// @Param range query string false "Range like 7d, 30d, 90d or custom"
+// @Param from query string false "Start date of custom range, YYYY-MM-DD"
+// @Param to query string false "End date of custom range, YYYY-MM-DD"
+// @Param sort query string false "timestamp, views, unique_views or clones. Prefix with - for descending order"
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} repo.RepositoryTrafficResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/repos/{name}/traffic [get]
+func HandleGetRepoTraffic(source TrafficSource, defaultWindow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		trafficRange, pagination, ok := parseListQuery(w, r, defaultWindow)
+		if !ok {
+			return
+		}
+		field, desc, err := utils.ParseSort(query, "timestamp", "timestamp", "views", "unique_views", "clones")
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name := mux.Vars(r)["name"]
+		repo, err := StoreGetRepositoryByName(ctx, name)
+		if err != nil {
+			logger.FromContext(ctx).Error("getting repository failed", "repo", name, logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+		if repo == nil {
+			utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+			return
+		}
+
+		traffic, err := source.GetTrafficData(ctx, trafficRange)
+		if err != nil {
+			logger.FromContext(ctx).Error("getting traffic data failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+
+		// Copy so sorting won't touch shared data
+		series := append([]TrafficData{}, traffic[name]...)
+		SortTraffic(series, field, desc)
+		from, to := pagination.Bounds(len(series))
+
+		utils.WriteJSON(w, http.StatusOK, RepositoryTrafficResponse{
+			Repository: *repo,
+			Totals:     Sum(series),
+			Data:       series[from:to],
+			Meta:       ListMeta{Range: trafficRange, Pagination: pagination},
+		})
+	}
+}
+
+// HandleGetTrafficTotals godoc
+// @Summary Aggregated traffic
+// @Description Returns traffic totals of all repositories and totals per day
+// @Tags traffic
+// @Produce json
+// @Param range query string false "Range like 7d, 30d, 90d or custom"
+// @Param from query string false "Start date of custom range, YYYY-MM-DD"
+// @Param to query string false "End date of custom range, YYYY-MM-DD"
+// @Param sort query string false "date, views, unique_views or clones. Prefix with - for descending order"
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} repo.TrafficTotalsResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/traffic/totals [get]
+func HandleGetTrafficTotals(source TrafficSource, defaultWindow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		trafficRange, pagination, ok := parseListQuery(w, r, defaultWindow)
+		if !ok {
+			return
+		}
+		field, desc, err := utils.ParseSort(query, "date", "date", "views", "unique_views", "clones")
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		traffic, err := source.GetTrafficData(ctx, trafficRange)
+		if err != nil {
+			logger.FromContext(ctx).Error("getting traffic data failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+
+		days := DailyTotals(traffic)
+		var totals Totals
+		for _, day := range days {
+			totals.Views += day.Views
+			totals.UniqueViews += day.UniqueViews
+			totals.Clones += day.Clones
+			totals.UniqueClones += day.UniqueClones
+		}
+		SortDailyTotals(days, field, desc)
+		from, to := pagination.Bounds(len(days))
+
+		utils.WriteJSON(w, http.StatusOK, TrafficTotalsResponse{
+			Totals:       totals,
+			Repositories: len(traffic),
+			Data:         days[from:to],
+			Meta:         ListMeta{Range: trafficRange, Pagination: pagination},
+		})
+	}
+}
+
+// parseListQuery parses range and pagination. Error response is written if parsing fails.
+func parseListQuery(w http.ResponseWriter, r *http.Request, defaultWindow string) (TrafficRange, utils.Pagination, bool) {
+	query := r.URL.Query()
+	trafficRange, err := ParseTrafficRange(query, defaultWindow, time.Now())
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return trafficRange, utils.Pagination{}, false
+	}
+	pagination, err := utils.ParsePagination(query)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return trafficRange, pagination, false
+	}
+	return trafficRange, pagination, true
+}
+
+// HandleExportTraffic godoc
+// @Summary Export traffic
+// @Description Streams traffic rows joined with repository data as CSV or NDJSON
+// @Tags traffic
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Param format path string true "csv or ndjson"
+// @Param repo query []string false "Repository names, all if missing"
+// @Param range query string false "Range like 7d, 30d, 90d or custom"
+// @Param from query string false "Start date of custom range, YYYY-MM-DD"
+// @Param to query string false "End date of custom range, YYYY-MM-DD"
+// @Success 200 {file} file
+// @Failure 400 {object} utils.ErrorResponse
+// @Router /api/v1/export/traffic.{format} [get]
+func HandleExportTraffic(defaultWindow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := mux.Vars(r)["format"]
+		query := r.URL.Query()
+		trafficRange, err := ParseTrafficRange(query, defaultWindow, time.Now())
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, ExportFilename(format, trafficRange)))
+		writer, err := NewExportWriter(format, w)
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Flush to client every now and then so big exports start downloading right away
+		flusher, _ := w.(http.Flusher)
+		const flushEvery = 500
+		rows := 0
+		filter := ExportFilter{Repos: ParseRepoFilter(query), Range: trafficRange}
+		err = StoreStreamTrafficWithMeta(r.Context(), filter, func(row ExportRow) error {
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+			rows++
+			if rows%flushEvery == 0 && flusher != nil {
+				if err := writer.Flush(); err != nil {
+					return err
+				}
+				flusher.Flush()
+			}
+			return nil
+		})
+		// Headers are already sent, so only thing to do is to log the error
+		if err != nil {
+			logger.FromContext(r.Context()).Error("export failed", "rows", rows, logger.FieldError, err)
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			logger.FromContext(r.Context()).Error("flushing export failed", logger.FieldError, err)
+		}
+	}
+}
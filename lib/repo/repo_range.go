@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RangeCustom is used when range is given with 'from' and 'to' query parameters
+	RangeCustom = "custom"
+	// MaxRangeDays limits how long ranges can be requested
+	MaxRangeDays = 366
+	dateLayout   = "2006-01-02"
+)
+
+// TrafficRange is a time window of traffic data
+type TrafficRange struct {
+	// Name is like "7d" or "custom"
+	Name string    `json:"name"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// IsCustom reports whether range was given with dates instead of a name
+func (r TrafficRange) IsCustom() bool {
+	return r.Name == RangeCustom
+}
+
+// Contains reports whether t is inside the range
+func (r TrafficRange) Contains(t time.Time) bool {
+	return !t.Before(r.From) && !t.After(r.To)
+}
+
+// NamedRange returns range ending at now. Name is amount of days, like "7d".
+// One extra day is included because GitHub API doesn't return data for current day.
+func NamedRange(name string, now time.Time) (TrafficRange, error) {
+	days, err := rangeDays(name)
+	if err != nil {
+		return TrafficRange{}, err
+	}
+	return TrafficRange{
+		Name: name,
+		From: now.AddDate(0, 0, -(days + 1)),
+		To:   now,
+	}, nil
+}
+
+// ParseTrafficRange reads 'range', 'from' and 'to' query parameters. Format is
+// '?range=7d|30d|90d|custom&from=2021-11-01&to=2021-11-30'. If range is missing
+// defaultName will be used.
+func ParseTrafficRange(query url.Values, defaultName string, now time.Time) (TrafficRange, error) {
+	name := strings.TrimSpace(query.Get("range"))
+	from := strings.TrimSpace(query.Get("from"))
+	to := strings.TrimSpace(query.Get("to"))
+
+	// Dates without range name means custom range
+	if name == "" && (from != "" || to != "") {
+		name = RangeCustom
+	}
+	if name == "" {
+		name = defaultName
+	}
+	if name != RangeCustom {
+		return NamedRange(name, now)
+	}
+
+	if from == "" {
+		return TrafficRange{}, errors.New("custom range requires 'from'")
+	}
+	fromTime, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return TrafficRange{}, fmt.Errorf("invalid 'from', expected format %s", dateLayout)
+	}
+	toTime := now
+	if to != "" {
+		toTime, err = time.Parse(dateLayout, to)
+		if err != nil {
+			return TrafficRange{}, fmt.Errorf("invalid 'to', expected format %s", dateLayout)
+		}
+		// Include whole last day
+		toTime = toTime.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	if toTime.Before(fromTime) {
+		return TrafficRange{}, errors.New("'from' must be before 'to'")
+	}
+	if toTime.Sub(fromTime) > time.Hour*24*MaxRangeDays {
+		return TrafficRange{}, fmt.Errorf("range can be at most %d days", MaxRangeDays)
+	}
+	return TrafficRange{Name: RangeCustom, From: fromTime, To: toTime}, nil
+}
+
+// FilterByRange returns traffic data that is inside the range
+func (r ReposByNameMap) FilterByRange(trafficRange TrafficRange) ReposByNameMap {
+	filtered := make(ReposByNameMap)
+	for name, traffic := range r {
+		for _, t := range traffic {
+			if trafficRange.Contains(t.Timestamp) {
+				filtered[name] = append(filtered[name], t)
+			}
+		}
+	}
+	return filtered
+}
+
+func rangeDays(name string) (int, error) {
+	if !strings.HasSuffix(name, "d") {
+		return 0, fmt.Errorf("invalid range '%s', expected days like 7d", name)
+	}
+	days, err := strconv.Atoi(strings.TrimSuffix(name, "d"))
+	if err != nil || days < 1 || days > MaxRangeDays {
+		return 0, fmt.Errorf("invalid range '%s', expected days like 7d", name)
+	}
+	return days, nil
+}
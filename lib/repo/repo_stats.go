@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Totals holds summed traffic
+type Totals struct {
+	Views        int `json:"views"`
+	UniqueViews  int `json:"unique_views"`
+	Clones       int `json:"clones"`
+	UniqueClones int `json:"unique_clones"`
+}
+
+// Add adds traffic of one day to totals
+func (t *Totals) Add(traffic TrafficData) {
+	t.Views += traffic.Views
+	t.UniqueViews += traffic.UniqueViews
+	t.Clones += traffic.Clones
+	t.UniqueClones += traffic.UniqueClones
+}
+
+// RepositorySummary is repository with its traffic totals
+type RepositorySummary struct {
+	RepositoryData
+	Totals
+	Days int `json:"days"`
+}
+
+// DailyTotal holds traffic of all repositories in one day
+type DailyTotal struct {
+	Date time.Time `json:"date"`
+	Totals
+}
+
+// Sum returns totals of traffic data
+func Sum(traffic []TrafficData) Totals {
+	var totals Totals
+	for _, t := range traffic {
+		totals.Add(t)
+	}
+	return totals
+}
+
+// Summaries combines repositories with their traffic. Repositories without traffic
+// get zero totals.
+func Summaries(repos []RepositoryData, traffic ReposByNameMap) []RepositorySummary {
+	summaries := make([]RepositorySummary, 0, len(repos))
+	for _, r := range repos {
+		summaries = append(summaries, RepositorySummary{
+			RepositoryData: r,
+			Totals:         Sum(traffic[r.Name]),
+			Days:           len(traffic[r.Name]),
+		})
+	}
+	return summaries
+}
+
+// DailyTotals sums traffic of all repositories per day, oldest first
+func DailyTotals(traffic ReposByNameMap) []DailyTotal {
+	byDay := make(map[time.Time]*DailyTotal)
+	for _, list := range traffic {
+		for _, t := range list {
+			day := t.Timestamp.UTC().Truncate(time.Hour * 24)
+			total, found := byDay[day]
+			if !found {
+				total = &DailyTotal{Date: day}
+				byDay[day] = total
+			}
+			total.Add(t)
+		}
+	}
+
+	days := make([]DailyTotal, 0, len(byDay))
+	for _, total := range byDay {
+		days = append(days, *total)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Date.Before(days[j].Date)
+	})
+	return days
+}
+
+// SortSummaries sorts by name, views, unique_views or clones
+func SortSummaries(summaries []RepositorySummary, field string, desc bool) {
+	sort.SliceStable(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if desc {
+			a, b = b, a
+		}
+		switch field {
+		case "views":
+			return a.Views < b.Views
+		case "unique_views":
+			return a.UniqueViews < b.UniqueViews
+		case "clones":
+			return a.Clones < b.Clones
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// SortTraffic sorts by timestamp, views, unique_views or clones
+func SortTraffic(traffic []TrafficData, field string, desc bool) {
+	sort.SliceStable(traffic, func(i, j int) bool {
+		a, b := traffic[i], traffic[j]
+		if desc {
+			a, b = b, a
+		}
+		switch field {
+		case "views":
+			return a.Views < b.Views
+		case "unique_views":
+			return a.UniqueViews < b.UniqueViews
+		case "clones":
+			return a.Clones < b.Clones
+		}
+		return a.Timestamp.Before(b.Timestamp)
+	})
+}
+
+// SortDailyTotals sorts by date, views, unique_views or clones
+func SortDailyTotals(days []DailyTotal, field string, desc bool) {
+	sort.SliceStable(days, func(i, j int) bool {
+		a, b := days[i], days[j]
+		if desc {
+			a, b = b, a
+		}
+		switch field {
+		case "views":
+			return a.Views < b.Views
+		case "unique_views":
+			return a.UniqueViews < b.UniqueViews
+		case "clones":
+			return a.Clones < b.Clones
+		}
+		return a.Date.Before(b.Date)
+	})
+}
@@ -1,18 +1,147 @@
 package repo
 
 import (
+	"bytes"
 	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 )
 
 func TestQueryReposWithMeta(t *testing.T) {
 	ts := time.Now().AddDate(0, 0, -365)
-	repos, err := StoreGetRepositoryTrafficWithMeta(context.Background(), ts)
+	repos, err := StoreGetRepositoryTrafficWithMeta(context.Background(), ts, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	log.Printf("repos: %+v\n", repos[0])
 }
+
+func TestParseTrafficRange(t *testing.T) {
+	now := time.Date(2021, 11, 20, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		query string
+		name  string
+		from  time.Time
+		ok    bool
+	}{
+		{"", "7d", now.AddDate(0, 0, -8), true},
+		{"range=30d", "30d", now.AddDate(0, 0, -31), true},
+		{"range=custom&from=2021-11-01&to=2021-11-10", RangeCustom, time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC), true},
+		{"from=2021-11-01", RangeCustom, time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC), true},
+		{"range=custom", "", time.Time{}, false},
+		{"range=custom&from=2021-11-10&to=2021-11-01", "", time.Time{}, false},
+		{"range=week", "", time.Time{}, false},
+		{"range=-7d", "", time.Time{}, false},
+		{"range=9999d", "", time.Time{}, false},
+	}
+
+	for _, item := range tt {
+		query, _ := url.ParseQuery(item.query)
+		r, err := ParseTrafficRange(query, "7d", now)
+		if (err == nil) != item.ok {
+			t.Error("unexpected error", item.query, err)
+			continue
+		}
+		if !item.ok {
+			continue
+		}
+		if r.Name != item.name || !r.From.Equal(item.from) {
+			t.Error("wrong range", item.query, r)
+		}
+	}
+}
+
+type fakeTrafficSource struct{}
+
+func (fakeTrafficSource) GetTrafficData(ctx context.Context, r TrafficRange) (ReposByNameMap, error) {
+	return ReposByNameMap{}, nil
+}
+
+func TestHandleTrafficTotals(t *testing.T) {
+	tt := []struct {
+		query  string
+		status int
+	}{
+		{"", 200},
+		{"?range=30d&sort=-views&page=2&per_page=10", 200},
+		{"?range=week", 400},
+		{"?sort=unknown", 400},
+		{"?per_page=1000", 400},
+		{"?page=0", 400},
+	}
+
+	for _, item := range tt {
+		req, err := http.NewRequest("GET", "/api/v1/traffic/totals"+item.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		HandleGetTrafficTotals(fakeTrafficSource{}, "7d")(recorder, req)
+		if recorder.Code != item.status {
+			t.Error("expected", item.status, "got", recorder.Code, "with", item.query, recorder.Body.String())
+		}
+	}
+}
+
+func TestExportWriters(t *testing.T) {
+	row := ExportRow{
+		Name:        "example",
+		URL:         "https://github.com/tuommii/example",
+		Timestamp:   time.Date(2021, 11, 20, 0, 0, 0, 0, time.UTC),
+		Views:       10,
+		UniqueViews: 3,
+		Clones:      2,
+	}
+	tt := []struct {
+		format   string
+		expected string
+	}{
+		{ExportCSV, "name,url,date,views,unique_views,clones,unique_clones\nexample,https://github.com/tuommii/example,2021-11-20,10,3,2,0\n"},
+		{ExportNDJSON, `{"name":"example","url":"https://github.com/tuommii/example","timestamp":"2021-11-20T00:00:00Z","views":10,"unique_views":3,"clones":2,"unique_clones":0}` + "\n"},
+	}
+
+	for _, item := range tt {
+		var buf bytes.Buffer
+		writer, err := NewExportWriter(item.format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Write(row); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != item.expected {
+			t.Errorf("%s: got %q", item.format, buf.String())
+		}
+	}
+
+	if _, err := NewExportWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("expected error with unknown format")
+	}
+}
+
+func TestDailySeries(t *testing.T) {
+	day := time.Date(2021, 11, 20, 0, 0, 0, 0, time.UTC)
+	traffic := []TrafficData{
+		{Views: 5, Timestamp: day},
+		{Views: 1, Timestamp: day.AddDate(0, 0, -3)},
+	}
+
+	series := dailySeries(traffic)
+	if len(series) != 4 {
+		t.Fatal("missing days were not filled", len(series))
+	}
+	if series[0].Views != 1 || series[1].Views != 0 || series[3].Views != 5 {
+		t.Error("wrong order or values", series)
+	}
+	if TemplateSparkline(nil) != "" || TemplateBarChart(nil) != "" {
+		t.Error("empty traffic should render nothing")
+	}
+}
@@ -0,0 +1,244 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Prefix tells token apart from other bearer tokens
+const Prefix = "dvp_"
+
+// Limits of token fields
+const (
+	maxNameLength    = 64
+	maxExpiresInDays = 365
+	maxTokensPerUser = 20
+)
+
+type contextKey int
+
+const tokenKey contextKey = iota
+
+// NewContext returns context with the token used in the request
+func NewContext(ctx context.Context, t *Token) context.Context {
+	return context.WithValue(ctx, tokenKey, t)
+}
+
+// FromContext returns the token used in the request or nil when request was not
+// authenticated with a token
+func FromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenKey).(*Token)
+	return t
+}
+
+// Hash returns hash of the token value. Tokens are random, so plain sha256 is enough.
+func Hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// generate returns a new random token value
+func generate() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return Prefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HandleCreateToken godoc
+// @Summary Create API token
+// @Description Creates a personal API token. Token is in the response only once.
+// @Tags tokens
+// @Accept json
+// @Produce json
+// @Param token body token.TokenInput true "Token"
+// @Success 201 {object} token.CreatedToken
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/tokens [post]
+func HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	input := TokenInput{}
+	if !utils.ReadJSON(w, r, &input) {
+		return
+	}
+	name := strings.TrimSpace(input.Name)
+	if name == "" || len(name) > maxNameLength {
+		utils.WriteJSONError(w, http.StatusBadRequest, "invalid 'name'")
+		return
+	}
+	u := auth.UserFromContext(r.Context())
+	if err := validateScopes(input.Scopes, u.Role); err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.ExpiresInDays < 0 || input.ExpiresInDays > maxExpiresInDays {
+		utils.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid 'expires_in_days', must be between 0 and %d", maxExpiresInDays))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+	log := logger.FromContext(ctx)
+
+	// Expired tokens don't count, so those don't have to be revoked first
+	count, err := StoreCountValidTokens(ctx, u.ID, time.Now())
+	if err != nil {
+		log.Error("counting tokens failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	if count >= maxTokensPerUser {
+		utils.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("user can have at most %d tokens", maxTokensPerUser))
+		return
+	}
+
+	value, err := generate()
+	if err != nil {
+		log.Error("generating token failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, "could not create token")
+		return
+	}
+	now := time.Now().UTC()
+	t := Token{
+		ID:        primitive.NewObjectID(),
+		UserID:    u.ID,
+		Name:      name,
+		Prefix:    value[:len(Prefix)+6],
+		Hash:      Hash(value),
+		Scopes:    input.Scopes,
+		CreatedAt: now,
+	}
+	if input.ExpiresInDays > 0 {
+		expires := now.AddDate(0, 0, input.ExpiresInDays)
+		t.ExpiresAt = &expires
+	}
+	if err := StoreCreateToken(ctx, &t); err != nil {
+		log.Error("saving token failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	log.Info("api token created", "token_id", t.ID.Hex(), "scopes", strings.Join(t.Scopes, ","))
+	audit.Record(r, audit.ActionTokenCreated, t.ID, map[string]interface{}{
+		"name":   t.Name,
+		"scopes": t.Scopes,
+	})
+	utils.WriteJSON(w, http.StatusCreated, CreatedToken{Token: t, Value: value})
+}
+
+// HandleListTokens godoc
+// @Summary List API tokens
+// @Description Lists tokens of the current user that are not revoked
+// @Tags tokens
+// @Produce json
+// @Success 200 {array} token.Token
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/tokens [get]
+func HandleListTokens(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	tokens, err := StoreGetUserTokens(ctx, auth.UserFromContext(ctx).ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("getting tokens failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// HandleRevokeToken godoc
+// @Summary Revoke API token
+// @Tags tokens
+// @Param id path string true "Token ID"
+// @Success 204
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/tokens/{id} [delete]
+func HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, consts.ErrInvalidID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	found, err := StoreRevokeToken(ctx, auth.UserFromContext(ctx).ID, id)
+	if err != nil {
+		logger.FromContext(ctx).Error("revoking token failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	if !found {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+	logger.FromContext(ctx).Info("api token revoked", "token_id", id.Hex())
+	audit.Record(r, audit.ActionTokenRevoked, id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateScopes checks that scopes are known, not repeated and granted to users
+// with role. Empty role is a viewer.
+func validateScopes(scopes []string, role string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("'scopes' is required, allowed: %s", strings.Join(AllScopes, ", "))
+	}
+	seen := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		known := false
+		for _, s := range AllScopes {
+			known = known || s == scope
+		}
+		if !known || seen[scope] {
+			return fmt.Errorf("invalid scope '%s', allowed: %s", scope, strings.Join(AllScopes, ", "))
+		}
+		seen[scope] = true
+		if !roleAllows(role, scope) {
+			return fmt.Errorf("scope '%s' is not allowed for your role", scope)
+		}
+	}
+	return nil
+}
+
+// roleAllows tells if users with role may create tokens with scope
+func roleAllows(role, scope string) bool {
+	roles, ok := scopeRoles[scope]
+	if !ok {
+		return true
+	}
+	if role == "" {
+		role = user.RoleViewer
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
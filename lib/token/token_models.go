@@ -0,0 +1,69 @@
+package token
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/lib/user"
+)
+
+// Scopes limit what a token can be used for
+const (
+	ScopeReadTraffic = "read:traffic"
+	ScopeAdminJobs   = "admin:jobs"
+)
+
+// AllScopes are scopes that can be given to a token
+var AllScopes = []string{ScopeReadTraffic, ScopeAdminJobs}
+
+// scopeRoles are roles whose users may create tokens with the scope. Scopes that
+// are not listed are allowed for every role.
+var scopeRoles = map[string][]string{
+	ScopeAdminJobs: {user.RoleMaintainer, user.RoleAdmin},
+}
+
+// Token is a personal API token. Only hash of the token is saved, the token
+// itself is shown once when it's created.
+type Token struct {
+	ID     primitive.ObjectID `bson:"_id" json:"id"`
+	UserID primitive.ObjectID `bson:"user_id" json:"-"`
+	Name   string             `bson:"name" json:"name"`
+	// Prefix is start of the token, so user can recognize it
+	Prefix     string     `bson:"prefix" json:"prefix"`
+	Hash       string     `bson:"hash" json:"-"`
+	Scopes     []string   `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty" json:"-"`
+}
+
+// HasScope tells if token has the scope
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid tells if token can be used at 'now'
+func (t *Token) IsValid(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// TokenInput is body of 'POST /api/v1/tokens'
+type TokenInput struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is validity of the token, 0 means it never expires
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// CreatedToken is response of 'POST /api/v1/tokens'
+type CreatedToken struct {
+	Token
+	// Value is the token. It can't be read later.
+	Value string `json:"token"`
+}
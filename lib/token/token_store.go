@@ -0,0 +1,104 @@
+package token
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/store"
+)
+
+// lastUsedPrecision limits writes, last use is updated at most once per this
+const lastUsedPrecision = time.Minute
+
+// StoreCreateToken saves token
+func StoreCreateToken(ctx context.Context, token *Token) error {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAPITokens)
+	_, err := coll.InsertOne(ctx, token)
+	return err
+}
+
+// StoreGetTokenByHash returns token with the hash, revoked and expired ones
+// included. Returns nil when token is not found.
+func StoreGetTokenByHash(ctx context.Context, hash string) (*Token, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAPITokens)
+
+	res := coll.FindOne(ctx, bson.M{"hash": hash})
+	err := res.Err()
+	// Not found "error". This needs to be handled seperatly
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token := &Token{}
+	return token, res.Decode(token)
+}
+
+// StoreGetUserTokens returns tokens of the user that are not revoked, newest first
+func StoreGetUserTokens(ctx context.Context, userID primitive.ObjectID) ([]Token, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAPITokens)
+
+	filter := bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, 0)
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// StoreCountValidTokens returns count of tokens of the user that are not revoked
+// or expired at now
+func StoreCountValidTokens(ctx context.Context, userID primitive.ObjectID, now time.Time) (int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAPITokens)
+
+	filter := bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expires_at": nil},
+			bson.M{"expires_at": bson.M{"$gt": now}},
+		},
+	}
+	return coll.CountDocuments(ctx, filter)
+}
+
+// StoreRevokeToken revokes token of the user. Returns false when token was not found.
+func StoreRevokeToken(ctx context.Context, userID, id primitive.ObjectID) (bool, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAPITokens)
+
+	filter := bson.M{"_id": id, "user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	res, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// StoreTouchToken sets last use of the token unless it was set less than a minute ago
+func StoreTouchToken(ctx context.Context, id primitive.ObjectID, now time.Time) error {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionAPITokens)
+
+	filter := bson.M{"_id": id, "$or": []bson.M{
+		{"last_used_at": bson.M{"$exists": false}},
+		{"last_used_at": bson.M{"$lt": now.Add(-lastUsedPrecision)}},
+	}}
+	_, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"last_used_at": now}})
+	return err
+}
@@ -0,0 +1,119 @@
+package token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/store"
+)
+
+func TestValidity(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	tt := []struct {
+		token Token
+		valid bool
+	}{
+		{Token{}, true},
+		{Token{ExpiresAt: &future}, true},
+		{Token{ExpiresAt: &past}, false},
+		{Token{RevokedAt: &past}, false},
+	}
+	for i, item := range tt {
+		if item.token.IsValid(now) != item.valid {
+			t.Error(i, "expected valid", item.valid)
+		}
+	}
+
+	scoped := Token{Scopes: []string{ScopeReadTraffic}}
+	if !scoped.HasScope(ScopeReadTraffic) || scoped.HasScope(ScopeAdminJobs) {
+		t.Error("wrong scopes")
+	}
+
+	for _, scopes := range [][]string{nil, {"write:everything"}, {ScopeReadTraffic, ScopeReadTraffic}} {
+		if validateScopes(scopes, user.RoleAdmin) == nil {
+			t.Error("scopes should be invalid", scopes)
+		}
+	}
+
+	// Self-registered viewers can't create job tokens
+	byRole := []struct {
+		role  string
+		scope string
+		valid bool
+	}{
+		{"", ScopeReadTraffic, true},
+		{user.RoleViewer, ScopeReadTraffic, true},
+		{"", ScopeAdminJobs, false},
+		{user.RoleViewer, ScopeAdminJobs, false},
+		{user.RoleMaintainer, ScopeAdminJobs, true},
+		{user.RoleAdmin, ScopeAdminJobs, true},
+	}
+	for _, item := range byRole {
+		if err := validateScopes([]string{item.scope}, item.role); (err == nil) != item.valid {
+			t.Error(item.role, item.scope, "expected valid", item.valid, "got", err)
+		}
+	}
+}
+
+func TestCreateAndRevoke(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+	ctx := auth.NewContext(context.Background(), &user.User{ID: primitive.NewObjectID(), Username: "jack"})
+
+	req := httptest.NewRequest("POST", "/api/v1/tokens", strings.NewReader(`{"name": "ci", "scopes": ["read:traffic"], "expires_in_days": 30}`))
+	rr := httptest.NewRecorder()
+	HandleCreateToken(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusCreated {
+		t.Fatal("create failed", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), `"hash"`) {
+		t.Error("hash in response", rr.Body.String())
+	}
+
+	tokens, err := StoreGetUserTokens(ctx, auth.UserFromContext(ctx).ID)
+	if err != nil || len(tokens) != 1 {
+		t.Fatal("token was not saved", tokens, err)
+	}
+	created := tokens[0]
+	if count, _ := StoreCountValidTokens(ctx, created.UserID, time.Now()); count != 1 {
+		t.Error("valid token should count", count)
+	}
+	if count, _ := StoreCountValidTokens(ctx, created.UserID, time.Now().AddDate(0, 0, 31)); count != 0 {
+		t.Error("expired token should not count", count)
+	}
+	found, err := StoreGetTokenByHash(ctx, created.Hash)
+	if err != nil || found == nil || !found.IsValid(time.Now()) || found.ExpiresAt == nil {
+		t.Fatal("token not found by hash", found, err)
+	}
+
+	if err := StoreTouchToken(ctx, created.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	found, _ = StoreGetTokenByHash(ctx, created.Hash)
+	if found.LastUsedAt == nil {
+		t.Error("last use was not set")
+	}
+
+	revoked, err := StoreRevokeToken(ctx, created.UserID, created.ID)
+	if err != nil || !revoked {
+		t.Fatal("revoke failed", err)
+	}
+	found, _ = StoreGetTokenByHash(ctx, created.Hash)
+	if found.IsValid(time.Now()) {
+		t.Error("revoked token should be invalid")
+	}
+	if count, _ := StoreCountValidTokens(ctx, created.UserID, time.Now()); count != 0 {
+		t.Error("revoked token should not count", count)
+	}
+	if revoked, _ := StoreRevokeToken(ctx, created.UserID, created.ID); revoked {
+		t.Error("token can be revoked only once")
+	}
+}
@@ -1,111 +1,424 @@
 package user
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
 	"miikka.xyz/devops-app/consts"
 	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/logger"
 	"miikka.xyz/devops-app/utils"
 )
 
+// Limits of user fields
+const (
+	maxUsernameLength = 32
+	maxNameLength     = 64
+	maxAvatarLength   = 512
+)
+
+var errInvalidRole = fmt.Errorf("invalid 'role', must be one of: %s", strings.Join(Roles, ", "))
+
+// HandleCreateUser godoc
+// @Summary Create user
+// @Description Creates an active user. Username can contain letters, numbers and underscores.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param user body user.UserInput true "User"
+// @Success 201 {object} user.User
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 409 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/users [post]
 func HandleCreateUser(ch *amqp.Channel) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Read request body
-		bytes, err := ioutil.ReadAll(io.LimitReader(r.Body, consts.MaxBodySizeBytes))
-		if err != nil {
-			log.Println(err)
-			http.Error(w, consts.ErrBody, http.StatusInternalServerError)
-			return
-		}
+		log := logger.FromContext(r.Context())
 
 		// JSON to UserInput
 		userInput := UserInput{}
-		err = json.Unmarshal(bytes, &userInput)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, consts.ErrJSON, http.StatusBadRequest)
+		if !utils.ReadJSON(w, r, &userInput) {
 			return
 		}
 
-		// Trim username
-		username := strings.TrimSpace(userInput.Username)
-		if username == "" || len(username) > 32 || !utils.OnlyAlphaNumberOrUnderscore(username) {
-			log.Println("invalid username", username)
-			http.Error(w, "invalid username", http.StatusBadRequest)
-			return
-		}
-		log.Printf("username after trimming: [%s]\n", username)
-
-		// Check is username already taken
-		userFound, err := StoreGetUserByUsername(username)
+		user, err := NewUser(userInput)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, consts.ErrDatabase, http.StatusInternalServerError)
+			log.Warn("invalid user", "username", userInput.Username, logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		if userFound != nil {
-			msg := fmt.Sprintf(consts.ErrAlreadyExists, username)
-			log.Println(msg)
-			http.Error(w, msg, http.StatusBadRequest)
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+		if !Create(ctx, w, ch, user) {
 			return
 		}
+		audit.Record(r, audit.ActionUserCreated, user.ID, map[string]interface{}{
+			"username": user.Username,
+			"role":     user.Role,
+		})
+
+		w.Header().Set("Location", "/api/v1/users/"+user.Username)
+		utils.WriteJSON(w, http.StatusCreated, user)
+	}
+}
+
+// NewUser validates input and returns user that can be created
+func NewUser(input UserInput) (*User, error) {
+	// Trim username
+	username := strings.TrimSpace(input.Username)
+	if username == "" || len(username) > maxUsernameLength || !utils.OnlyAlphaNumberOrUnderscore(username) {
+		return nil, errors.New("invalid username")
+	}
 
-		// Create new user
-		id, err := StoreCreateUser(&userInput)
+	user := &User{
+		Username:  username,
+		FirstName: strings.TrimSpace(input.FirstName),
+		LastName:  strings.TrimSpace(input.LastName),
+		Avatar:    strings.TrimSpace(input.Avatar),
+	}
+	if err := validateFields(user.FirstName, user.LastName, user.Avatar); err != nil {
+		return nil, err
+	}
+	if input.DateOfBirth != "" {
+		dob, err := parseDate(input.DateOfBirth)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, consts.ErrDatabase, http.StatusInternalServerError)
-			return
+			return nil, err
 		}
+		user.DateOfBirth = &dob
+	}
+	if input.Role != "" {
+		if !IsRole(input.Role) {
+			return nil, errInvalidRole
+		}
+		user.Role = input.Role
+	}
+	return user, nil
+}
+
+// Create saves new user and publishes user created event. Error response is
+// written when username is taken or saving fails.
+func Create(ctx context.Context, w http.ResponseWriter, ch *amqp.Channel, user *User) bool {
+	log := logger.FromContext(ctx)
+
+	// Check is username already taken
+	exists, err := StoreUsernameExists(ctx, user.Username)
+	if err != nil {
+		log.Error("getting user failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return false
+	}
+	if exists {
+		msg := fmt.Sprintf(consts.ErrAlreadyExists, user.Username)
+		log.Warn(msg)
+		utils.WriteJSONError(w, http.StatusConflict, msg)
+		return false
+	}
 
-		// Publish user created event in background
-		// Some tests might use nil value so check it
-		if ch != nil {
-			go func() {
-				event := events.Event{
-					CreatedAt: time.Now(),
-					ObjectID:  id,
-					Type:      consts.EventUserCreated,
-				}
-				err = events.Publish(ch, &event)
-				if err != nil {
-					log.Println(err)
-				}
-			}()
+	// Create new user. Unique index rejects the username if it was taken
+	// after the check above.
+	if err := StoreCreateUser(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			utils.WriteJSONError(w, http.StatusConflict, fmt.Sprintf(consts.ErrAlreadyExists, user.Username))
+			return false
 		}
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return false
+	}
 
-		fmt.Fprintln(w, id.Hex())
+	// Publish user created event in background
+	// Some tests might use nil value so check it
+	if ch != nil {
+		// Request context is canceled when handler returns, so only the span is kept
+		eventCtx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+		event := CreatedEvent(user, logger.RequestID(ctx))
+		go func() {
+			if err := events.Publish(eventCtx, ch, &event); err != nil {
+				log.Error("publishing event failed", logger.FieldError, err)
+			}
+		}()
 	}
+	return true
 }
 
-// HandleGetUserByUsername
+// HandleGetUserByUsername godoc
+// @Summary Get user
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} user.User
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/users/{username} [get]
 func HandleGetUserByUsername(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 	if username == "" {
-		http.Error(w, consts.ErrNotFound, http.StatusNotFound)
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	user, err := StoreGetUserByUsername(ctx, username)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	if user == nil {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, user)
+}
+
+// HandleListUsers godoc
+// @Summary List users
+// @Description Lists users ordered by username. Deleted users are not listed.
+// @Tags users
+// @Produce json
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} user.UserListResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/users [get]
+func HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	pagination, err := utils.ParsePagination(r.URL.Query())
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	skip := int64((pagination.Page - 1) * pagination.PerPage)
+	users, total, err := StoreGetUsers(ctx, skip, int64(pagination.PerPage))
+	if err != nil {
+		logger.FromContext(ctx).Error("getting users failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	pagination.Total = int(total)
+
+	utils.WriteJSON(w, http.StatusOK, UserListResponse{
+		Data: users,
+		Meta: UserListMeta{Pagination: pagination},
+	})
+}
+
+// HandleUpdateUser godoc
+// @Summary Update user
+// @Description Updates given fields. Username can't be changed.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param user body user.UserUpdate true "Fields to update"
+// @Success 200 {object} user.User
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/users/{username} [patch]
+func HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	update := UserUpdate{}
+	if !utils.ReadJSON(w, r, &update) {
 		return
 	}
 
-	user, err := StoreGetUserByUsername(username)
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	username := mux.Vars(r)["username"]
+	user, err := StoreGetUserByUsername(ctx, username)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, consts.ErrDatabase, http.StatusInternalServerError)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
 		return
 	}
 	if user == nil {
-		log.Println(err)
-		http.Error(w, consts.ErrNotFound, http.StatusNotFound)
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+
+	set, err := update.toSet(user)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	updated, err := StoreUpdateUser(ctx, username, set)
+	if err != nil {
+		logger.FromContext(ctx).Error("updating user failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	// Deleted in the meantime
+	if updated == nil {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+
+	// Update that didn't change anything is not recorded
+	if fields := changedFields(user, updated); len(fields) > 0 {
+		audit.Record(r, audit.ActionUserUpdated, user.ID, map[string]interface{}{
+			"username": user.Username,
+			"fields":   fields,
+		})
+	}
+	if updated.Role != user.Role {
+		audit.Record(r, audit.ActionRoleChanged, user.ID, map[string]interface{}{
+			"username": user.Username,
+			"from":     user.Role,
+			"to":       updated.Role,
+		})
+	}
+	utils.WriteJSON(w, http.StatusOK, updated)
+}
+
+// HandleDeleteUser godoc
+// @Summary Delete user
+// @Description Marks user deleted. Username of deleted user can't be taken again.
+// @Tags users
+// @Param username path string true "Username"
+// @Success 204
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/users/{username} [delete]
+func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	username := mux.Vars(r)["username"]
+	deleted, err := StoreDeleteUser(ctx, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("deleting user failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
 		return
 	}
-	fmt.Fprintln(w, user.Username)
+	if deleted == nil {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+	audit.Record(r, audit.ActionUserDeleted, deleted.ID, map[string]interface{}{"username": username})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toSet validates the update and returns fields to set. Full name is rebuilt
+// from first and last name of the user.
+func (u *UserUpdate) toSet(user *User) (bson.M, error) {
+	set := bson.M{}
+	first, last, avatar := user.FirstName, user.LastName, user.Avatar
+	if u.FirstName != nil {
+		first = strings.TrimSpace(*u.FirstName)
+		set["first_name"] = first
+	}
+	if u.LastName != nil {
+		last = strings.TrimSpace(*u.LastName)
+		set["last_name"] = last
+	}
+	if u.Avatar != nil {
+		avatar = strings.TrimSpace(*u.Avatar)
+		set["avatar"] = avatar
+	}
+	if err := validateFields(first, last, avatar); err != nil {
+		return nil, err
+	}
+	set["full_name"] = fullName(first, last)
+
+	if u.DateOfBirth != nil {
+		if *u.DateOfBirth == "" {
+			set["date_of_birth"] = nil
+		} else {
+			dob, err := parseDate(*u.DateOfBirth)
+			if err != nil {
+				return nil, err
+			}
+			set["date_of_birth"] = dob
+		}
+	}
+	if u.IsActive != nil {
+		set["is_active"] = *u.IsActive
+	}
+	if u.Role != nil {
+		if !IsRole(*u.Role) {
+			return nil, errInvalidRole
+		}
+		set["role"] = *u.Role
+	}
+	return set, nil
+}
+
+// CreatedEvent returns user_created event of user. The user is the object of the event.
+func CreatedEvent(user *User, correlationID string) events.Event {
+	return events.Event{
+		CreatedAt:     time.Now(),
+		ObjectID:      user.ID,
+		Type:          consts.EventUserCreated,
+		CorrelationID: correlationID,
+		Data:          map[string]interface{}{"username": user.Username},
+	}
+}
+
+// changedFields returns sorted names of fields that differ between user before
+// and after an update
+func changedFields(before, after *User) []string {
+	fields := make([]string, 0)
+	changed := map[string]bool{
+		"first_name":    before.FirstName != after.FirstName,
+		"last_name":     before.LastName != after.LastName,
+		"full_name":     before.FullName != after.FullName,
+		"avatar":        before.Avatar != after.Avatar,
+		"is_active":     before.IsActive != after.IsActive,
+		"role":          before.Role != after.Role,
+		"date_of_birth": !sameTime(before.DateOfBirth, after.DateOfBirth),
+	}
+	for field, ok := range changed {
+		if ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// validateFields checks names and avatar URL
+func validateFields(firstName, lastName, avatar string) error {
+	if len(firstName) > maxNameLength || len(lastName) > maxNameLength {
+		return fmt.Errorf("names can be at most %d characters", maxNameLength)
+	}
+	if avatar == "" {
+		return nil
+	}
+	if len(avatar) > maxAvatarLength || !(strings.HasPrefix(avatar, "https://") || strings.HasPrefix(avatar, "http://")) {
+		return errors.New("invalid 'avatar', must be a http(s) URL")
+	}
+	return nil
+}
+
+// parseDate parses date of birth, which can't be in the future
+func parseDate(value string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil || t.After(time.Now()) {
+		return time.Time{}, errors.New("invalid 'date_of_birth', use format 2006-01-02")
+	}
+	return t, nil
 }
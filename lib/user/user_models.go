@@ -1,26 +1,114 @@
 package user
 
 import (
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/utils"
 )
 
 const CollectionName = "users"
 
+// Roles. Viewers read data, maintainers also run jobs and admins manage users.
+const (
+	RoleViewer     = "viewer"
+	RoleMaintainer = "maintainer"
+	RoleAdmin      = "admin"
+)
+
+// Roles are all roles from the least to the most privileged
+var Roles = []string{RoleViewer, RoleMaintainer, RoleAdmin}
+
+// IsRole tells if role is known
+func IsRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
-	ID          primitive.ObjectID `bson:"_id"`
-	FirstName   string             `bson:"first_name"`
-	LastName    string             `bson:"last_name"`
-	FullName    string             `bson:"full_name"`
-	Username    string             `bson:"username"`
-	Age         int                `bson:"age"`
-	DateOfBirth time.Time          `bson:"date_of_birth"`
-	Avatar      string             `bson:"avatar,omitempty"`
-	IsActive    bool               `bson:"is_active"`
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	FirstName string             `bson:"first_name" json:"first_name"`
+	LastName  string             `bson:"last_name" json:"last_name"`
+	FullName  string             `bson:"full_name" json:"full_name"`
+	Username  string             `bson:"username" json:"username"`
+	// Age is computed from DateOfBirth when user is read
+	Age         int        `bson:"-" json:"age,omitempty"`
+	DateOfBirth *time.Time `bson:"date_of_birth,omitempty" json:"date_of_birth,omitempty"`
+	Avatar      string     `bson:"avatar,omitempty" json:"avatar,omitempty"`
+	IsActive    bool       `bson:"is_active" json:"is_active"`
+	// Role is one of Roles, users saved before roles are viewers
+	Role string `bson:"role" json:"role"`
+	// PasswordHash is bcrypt hash of the password. Users without password can't log in.
+	PasswordHash string    `bson:"password_hash,omitempty" json:"-"`
+	CreatedAt    time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `bson:"updated_at" json:"updated_at"`
+	// DeletedAt is set when user is deleted. Deleted users are kept so their
+	// usernames can't be taken again.
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"-"`
+}
+
+// fullName joins first and last name
+func fullName(first, last string) string {
+	return strings.TrimSpace(first + " " + last)
+}
+
+// normalize sets values of fields that were added later
+func (u *User) normalize(now time.Time) {
+	if u.Role == "" {
+		u.Role = RoleViewer
+	}
+	u.setAge(now)
 }
 
+// setAge sets age in full years at 'now'
+func (u *User) setAge(now time.Time) {
+	if u.DateOfBirth == nil {
+		u.Age = 0
+		return
+	}
+	dob := *u.DateOfBirth
+	age := now.Year() - dob.Year()
+	if now.Month() < dob.Month() || (now.Month() == dob.Month() && now.Day() < dob.Day()) {
+		age--
+	}
+	u.Age = age
+}
+
+// UserInput is body of 'POST /api/v1/users'
 type UserInput struct {
 	Username  string `json:"username"`
-	FirstName string `json:"firstName"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	// DateOfBirth is in format 2006-01-02
+	DateOfBirth string `json:"date_of_birth"`
+	Avatar      string `json:"avatar"`
+	// Role defaults to viewer
+	Role string `json:"role"`
+}
+
+// UserUpdate is body of 'PATCH /api/v1/users/{username}'. Only given fields are updated.
+type UserUpdate struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	// DateOfBirth is in format 2006-01-02, empty string clears it
+	DateOfBirth *string `json:"date_of_birth"`
+	Avatar      *string `json:"avatar"`
+	IsActive    *bool   `json:"is_active"`
+	Role        *string `json:"role"`
+}
+
+// UserListMeta is returned with list of users
+type UserListMeta struct {
+	Pagination utils.Pagination `json:"pagination"`
+}
+
+// UserListResponse is response of 'GET /api/v1/users'
+type UserListResponse struct {
+	Data []User       `json:"data"`
+	Meta UserListMeta `json:"meta"`
 }
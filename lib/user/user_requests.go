@@ -15,14 +15,14 @@ func RequestCreateUser(user UserInput, ch *amqp.Channel) (*httptest.ResponseReco
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", "/user", bytes.NewBuffer(bytesJson))
+	req, err := http.NewRequest("POST", "/api/v1/users", bytes.NewBuffer(bytesJson))
 	req.Header.Set("Content-Type", "application/json")
 	if err != nil {
 		return nil, err
 	}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/user", HandleCreateUser(ch))
+	router.HandleFunc("/api/v1/users", HandleCreateUser(ch))
 	recorder := httptest.NewRecorder()
 	router.ServeHTTP(recorder, req)
 
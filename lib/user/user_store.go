@@ -2,95 +2,219 @@ package user
 
 import (
 	"context"
-	"errors"
-	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/logger"
 	"miikka.xyz/devops-app/store"
 )
 
-func StoreCreateUser(user *UserInput) (primitive.ObjectID, error) {
+// notDeleted matches users that are not deleted when used as value of deleted_at
+var notDeleted = bson.M{"$exists": false}
+
+// StoreCreateUser saves new active user. ID and timestamps are set here.
+func StoreCreateUser(ctx context.Context, user *User) error {
 	client := store.GetClient()
 	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
-	res, err := coll.InsertOne(context.TODO(), user)
+
+	now := time.Now().UTC()
+	user.ID = primitive.NewObjectID()
+	user.FullName = fullName(user.FirstName, user.LastName)
+	user.IsActive = true
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	user.normalize(now)
+
+	_, err := coll.InsertOne(ctx, user)
 	if err != nil {
-		log.Println(err)
-		return primitive.NilObjectID, err
+		logger.FromContext(ctx).Error("inserting user failed", logger.FieldError, err)
+		return err
 	}
-	id, ok := res.InsertedID.(primitive.ObjectID)
-	if !ok {
-		log.Println("should never happen: ", consts.ErrInvalidID)
-		return primitive.NilObjectID, errors.New(consts.ErrInvalidID)
+	return nil
+}
+
+// StoreUsernameExists tells if username is taken. Usernames of deleted users stay taken.
+func StoreUsernameExists(ctx context.Context, username string) (bool, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
+	count, err := coll.CountDocuments(ctx, bson.M{"username": username}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
 	}
-	return id, nil
+	return count > 0, nil
 }
 
-func StoreGetUserByUsername(username string) (*User, error) {
+// StoreGetUserByUsername returns user that is not deleted. Returns nil when user is not found.
+func StoreGetUserByUsername(ctx context.Context, username string) (*User, error) {
 	client := store.GetClient()
 	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
-	res := coll.FindOne(context.TODO(), bson.M{"username": username})
+	res := coll.FindOne(ctx, bson.M{"username": username, "deleted_at": notDeleted})
 	err := res.Err()
 	// Not found "error". This needs to be handled seperatly
-	if err != nil && err.Error() == mongo.ErrNoDocuments.Error() {
+	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
 	// "Real" error
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("finding user failed", "username", username, logger.FieldError, err)
 		return nil, err
 	}
 
 	user := User{}
 	err = res.Decode(&user)
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("decoding user failed", logger.FieldError, err)
 		return nil, err
 	}
+	user.normalize(time.Now())
 	return &user, nil
 }
 
-func StoreGetUsersByUsername(usernames []string) ([]User, error) {
+// StoreGetUserByID returns user that is not deleted. Returns nil when user is not found.
+func StoreGetUserByID(ctx context.Context, id primitive.ObjectID) (*User, error) {
 	client := store.GetClient()
 	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
-	users := make([]User, 0)
-
-	cursor, err := coll.Find(context.TODO(), bson.M{"username": bson.M{"$in": usernames}})
+	res := coll.FindOne(ctx, bson.M{"_id": id, "deleted_at": notDeleted})
+	err := res.Err()
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
-	err = cursor.All(context.TODO(), &users)
+	user := User{}
+	if err := res.Decode(&user); err != nil {
+		return nil, err
+	}
+	user.normalize(time.Now())
+	return &user, nil
+}
+
+// StoreGetUsers returns users that are not deleted ordered by username, and total count of them
+func StoreGetUsers(ctx context.Context, skip, limit int64) ([]User, int64, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
+
+	total, err := coll.CountDocuments(ctx, bson.M{"deleted_at": notDeleted})
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.M{"username": 1}).
+		SetSkip(skip).
+		SetLimit(limit)
+	cursor, err := coll.Find(ctx, bson.M{"deleted_at": notDeleted}, opts)
 	if err != nil {
-		log.Println(err)
+		return nil, 0, err
+	}
+
+	users := make([]User, 0)
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	setAges(users)
+	return users, total, nil
+}
+
+// StoreUpdateUser sets fields of user that is not deleted and returns updated user.
+// Returns nil when user is not found.
+func StoreUpdateUser(ctx context.Context, username string, set bson.M) (*User, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
+
+	set["updated_at"] = time.Now().UTC()
+	filter := bson.M{"username": username, "deleted_at": notDeleted}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := coll.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts)
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	user := User{}
+	if err := res.Decode(&user); err != nil {
 		return nil, err
 	}
+	user.normalize(time.Now())
+	return &user, nil
+}
 
-	return users, nil
+// StoreDeleteUser marks user deleted and inactive and returns the deleted user.
+// Returns nil when user was not found.
+func StoreDeleteUser(ctx context.Context, username string) (*User, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
+
+	now := time.Now().UTC()
+	filter := bson.M{"username": username, "deleted_at": notDeleted}
+	update := bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now, "is_active": false}}
+	res := coll.FindOneAndUpdate(ctx, filter, update)
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	user := User{}
+	if err := res.Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-func StoreGetUsersByID(ids []primitive.ObjectID) ([]User, error) {
+func StoreGetUsersByUsername(ctx context.Context, usernames []string) ([]User, error) {
 	client := store.GetClient()
 	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
 	users := make([]User, 0)
 
-	cursor, err := coll.Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	cursor, err := coll.Find(ctx, bson.M{"username": bson.M{"$in": usernames}, "deleted_at": notDeleted})
+	if err != nil {
+		logger.FromContext(ctx).Error("finding users failed", logger.FieldError, err)
+		return nil, err
+	}
+
+	err = cursor.All(ctx, &users)
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("decoding users failed", logger.FieldError, err)
 		return nil, err
 	}
-	err = cursor.Err()
+	setAges(users)
+	return users, nil
+}
+
+func StoreGetUsersByID(ctx context.Context, ids []primitive.ObjectID) ([]User, error) {
+	client := store.GetClient()
+	coll := client.Database(consts.DatabaseName).Collection(consts.CollectionUsers)
+	users := make([]User, 0)
+
+	cursor, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "deleted_at": notDeleted})
 	if err != nil {
-		log.Println(err)
+		logger.FromContext(ctx).Error("finding users failed", logger.FieldError, err)
 		return nil, err
 	}
 
-	err = cursor.Decode(&users)
+	err = cursor.All(ctx, &users)
 	if err != nil {
+		logger.FromContext(ctx).Error("decoding users failed", logger.FieldError, err)
 		return nil, err
 	}
+	setAges(users)
 	return users, nil
 }
+
+// setAges sets age and defaults of every user
+func setAges(users []User) {
+	now := time.Now()
+	for i := range users {
+		users[i].normalize(now)
+	}
+}
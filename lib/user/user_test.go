@@ -2,14 +2,17 @@ package user
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"miikka.xyz/devops-app/consts"
 	"miikka.xyz/devops-app/events"
 	"miikka.xyz/devops-app/store"
@@ -28,15 +31,15 @@ func TestHandleCreateUser(t *testing.T) {
 		username string
 		status   int
 	}{
-		{"tuommii", 200},
-		{"tuommii", 400},
+		{"tuommii", 201},
+		{"tuommii", 409},
 		{"", 400},
 		{"\t\t\t\t\r\r\r\"\"\"", 400},
 		{"wayyyyyyyyyyyyytooooloooonguuuserrnameeeeeeeeeeeeeeee", 400},
 		{"     tuommii   ", 400},
-		{"                  miikka                                       ", 200},
+		{"                  miikka                                       ", 201},
 		{";miikka;", 400},
-		{"jack_bauer", 200},
+		{"jack_bauer", 201},
 	}
 
 	for _, item := range tt {
@@ -109,7 +112,7 @@ func TestStoreGetMultipleUsers(t *testing.T) {
 	createExampleUsers(t)
 
 	exampleUsers := []string{"user1", "user2", "user3"}
-	users, err := StoreGetUsersByUsername(exampleUsers)
+	users, err := StoreGetUsersByUsername(context.Background(), exampleUsers)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,10 +127,10 @@ func createExampleUsers(t *testing.T) {
 		username string
 		status   int
 	}{
-		{"user1", 200},
-		{"user2", 200},
-		{"user3", 200},
-		{"user4", 200},
+		{"user1", 201},
+		{"user2", 201},
+		{"user3", 201},
+		{"user4", 201},
 	}
 	for _, item := range tt {
 		rr, err := RequestCreateUser(UserInput{
@@ -142,3 +145,98 @@ func createExampleUsers(t *testing.T) {
 		}
 	}
 }
+
+// Update, list and delete through the same routes as the server
+func TestUserResource(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+
+	createExampleUsers(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users", HandleListUsers).Methods("GET")
+	router.HandleFunc("/users/{username}", HandleGetUserByUsername).Methods("GET")
+	router.HandleFunc("/users/{username}", HandleUpdateUser).Methods("PATCH")
+	router.HandleFunc("/users/{username}", HandleDeleteUser).Methods("DELETE")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	rr := do("PATCH", "/users/user1", `{"last_name": "Bauer", "date_of_birth": "1990-01-02"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatal("update failed", rr.Code, rr.Body.String())
+	}
+	updated := User{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.FullName != "Example Bauer" || updated.Age < 30 || !updated.IsActive {
+		t.Error("wrong user after update", updated)
+	}
+	if rr := do("PATCH", "/users/user1", `{"date_of_birth": "01.02.1990"}`); rr.Code != http.StatusBadRequest {
+		t.Error("invalid date should fail", rr.Code)
+	}
+	if updated.Role != RoleViewer {
+		t.Error("role should default to viewer, got", updated.Role)
+	}
+	if rr := do("PATCH", "/users/user1", `{"role": "maintainer"}`); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"role":"maintainer"`) {
+		t.Error("role update failed", rr.Code, rr.Body.String())
+	}
+	if rr := do("PATCH", "/users/user1", `{"role": "owner"}`); rr.Code != http.StatusBadRequest {
+		t.Error("unknown role should fail", rr.Code)
+	}
+
+	if rr := do("DELETE", "/users/user2", ""); rr.Code != http.StatusNoContent {
+		t.Fatal("delete failed", rr.Code, rr.Body.String())
+	}
+	for _, item := range []struct {
+		method string
+		status int
+	}{{"GET", 404}, {"PATCH", 404}, {"DELETE", 404}} {
+		if rr := do(item.method, "/users/user2", "{}"); rr.Code != item.status {
+			t.Error(item.method, "deleted user should be", item.status, "got", rr.Code)
+		}
+	}
+	// Username of deleted user stays taken
+	if rr, _ := RequestCreateUser(UserInput{Username: "user2"}, nil); rr.Code != http.StatusConflict {
+		t.Error("expected conflict, got", rr.Code)
+	}
+	// Concurrent create that passed the check is rejected by the unique index
+	if err := StoreCreateUser(context.Background(), &User{Username: "user2"}); !mongo.IsDuplicateKeyError(err) {
+		t.Error("expected duplicate key error, got", err)
+	}
+
+	rr = do("GET", "/users?per_page=2&page=2", "")
+	list := UserListResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatal(err, rr.Body.String())
+	}
+	if list.Meta.Pagination.Total != 3 || len(list.Data) != 1 || list.Data[0].Username != "user4" {
+		t.Error("wrong list", list)
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	dob := time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC)
+	sameDob := dob
+	before := &User{FirstName: "Miikka", FullName: "Miikka", Role: RoleViewer, IsActive: true, DateOfBirth: &dob}
+
+	same := *before
+	same.DateOfBirth = &sameDob
+	if fields := changedFields(before, &same); len(fields) != 0 {
+		t.Error("nothing should have changed", fields)
+	}
+
+	after := *before
+	after.LastName = "T"
+	after.FullName = "Miikka T"
+	after.Role = RoleAdmin
+	after.DateOfBirth = nil
+	fields := changedFields(before, &after)
+	if strings.Join(fields, ",") != "date_of_birth,full_name,last_name,role" {
+		t.Error(fields)
+	}
+}
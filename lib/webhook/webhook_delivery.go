@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/feed"
+)
+
+// Request headers. Receivers verify the signature before trusting the body.
+const (
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+)
+
+// EventPayload is the body of json format
+type EventPayload struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Summary   string                 `json:"summary"`
+	Link      string                 `json:"link"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// Payload builds request body of event in format. Titles and summaries are the
+// same as in feeds.
+func Payload(format string, event events.Event, baseURL string) ([]byte, error) {
+	entry := feed.EntryFromEvent(event, baseURL)
+	switch format {
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": chatText(entry)})
+	case FormatDiscord:
+		return json.Marshal(map[string]string{"content": chatText(entry)})
+	}
+	return json.Marshal(EventPayload{
+		ID:        event.ID.Hex(),
+		Type:      event.Type,
+		Title:     entry.Title,
+		Summary:   entry.Summary,
+		Link:      entry.Link,
+		CreatedAt: event.CreatedAt,
+		Data:      event.Data,
+	})
+}
+
+// chatText is a message for Slack and Discord
+func chatText(entry feed.Entry) string {
+	text := "*" + entry.Title + "*"
+	if entry.Summary != "" {
+		text += "\n" + entry.Summary
+	}
+	return text + "\n" + entry.Link
+}
+
+// Sign returns hex encoded HMAC-SHA256 of timestamp and body joined with a dot.
+// Timestamp is signed so captured requests can't be replayed later.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// send makes one request of delivery. Attempt has status code or error.
+func send(ctx context.Context, client *http.Client, hook *Webhook, delivery *Delivery) (attempt Attempt) {
+	start := time.Now()
+	attempt = Attempt{At: start.UTC()}
+	// Named result, so the duration is set on the returned value
+	defer func() {
+		attempt.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "devops-app-webhook/"+consts.Version)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, body))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, delivery.ID.Hex())
+
+	res, err := client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	// Reading the body lets the connection be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	attempt.StatusCode = res.StatusCode
+	if !succeeded(attempt) {
+		attempt.Error = fmt.Sprintf("unexpected status %d", res.StatusCode)
+	}
+	return attempt
+}
+
+func succeeded(attempt Attempt) bool {
+	return attempt.StatusCode >= 200 && attempt.StatusCode < 300
+}
+
+// retryable tells if failed attempt could succeed later. Other client errors
+// would fail again.
+func retryable(attempt Attempt) bool {
+	switch {
+	case attempt.StatusCode == 0:
+		return true
+	case attempt.StatusCode == http.StatusRequestTimeout, attempt.StatusCode == http.StatusTooManyRequests:
+		return true
+	}
+	return attempt.StatusCode >= 500
+}
@@ -0,0 +1,393 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Secret limits
+const (
+	minSecretLength = 16
+	maxSecretLength = 256
+	maxURLLength    = 2048
+)
+
+// HandleCreateWebhook godoc
+// @Summary Create webhook
+// @Description Subscribes an endpoint to event types. Secret is in the response only once.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security AdminToken
+// @Param webhook body webhook.WebhookInput true "Webhook"
+// @Success 201 {object} webhook.CreatedWebhook
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/webhooks [post]
+func HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	input := WebhookInput{}
+	if !utils.ReadJSON(w, r, &input) {
+		return
+	}
+	if err := validate(&input); err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+	log := logger.FromContext(ctx)
+
+	secret := input.Secret
+	if secret == "" {
+		var err error
+		if secret, err = generateSecret(); err != nil {
+			log.Error("generating secret failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not create webhook")
+			return
+		}
+	}
+	hook := Webhook{
+		ID:        primitive.NewObjectID(),
+		URL:       input.URL,
+		Secret:    secret,
+		Types:     input.Types,
+		Format:    input.Format,
+		CreatedBy: audit.ActorFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := StoreCreateWebhook(ctx, &hook); err != nil {
+		log.Error("saving webhook failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	log.Info("webhook created", "webhook", hook.ID.Hex(), "types", strings.Join(hook.Types, ","))
+	// URL may contain a token of the receiver, so only its host is recorded
+	audit.Record(r, audit.ActionWebhookCreated, hook.ID, map[string]interface{}{
+		"host":   hostOf(hook.URL),
+		"types":  hook.Types,
+		"format": hook.Format,
+	})
+	utils.WriteJSON(w, http.StatusCreated, CreatedWebhook{Webhook: hook, Secret: secret})
+}
+
+// HandleListWebhooks godoc
+// @Summary List webhooks
+// @Description Lists webhooks that are not deleted, newest first
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 200 {array} webhook.Webhook
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/webhooks [get]
+func HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	hooks, err := StoreGetWebhooks(ctx, "")
+	if err != nil {
+		logger.FromContext(ctx).Error("getting webhooks failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, hooks)
+}
+
+// HandleDeleteWebhook godoc
+// @Summary Delete webhook
+// @Description Stops deliveries to the webhook. Its deliveries are kept.
+// @Tags admin
+// @Security AdminToken
+// @Param id path string true "Webhook ID"
+// @Success 204
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/webhooks/{id} [delete]
+func HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, consts.ErrInvalidID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	found, err := StoreDeleteWebhook(ctx, id)
+	if err != nil {
+		logger.FromContext(ctx).Error("deleting webhook failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	if !found {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return
+	}
+	logger.FromContext(ctx).Info("webhook deleted", "webhook", id.Hex())
+	audit.Record(r, audit.ActionWebhookDeleted, id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListDeliveries godoc
+// @Summary List webhook deliveries
+// @Description Lists newest deliveries of a webhook with every attempt
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Webhook ID"
+// @Param status query string false "pending, succeeded or failed"
+// @Param page query int false "Page, starts from 1"
+// @Param per_page query int false "Items per page, max 100"
+// @Success 200 {object} webhook.DeliveryListResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/webhooks/{id}/deliveries [get]
+func HandleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, consts.ErrInvalidID)
+		return
+	}
+	query := r.URL.Query()
+	pagination, err := utils.ParsePagination(query)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	status := query.Get("status")
+	if status != "" && status != StatusPending && status != StatusSucceeded && status != StatusFailed {
+		utils.WriteJSONError(w, http.StatusBadRequest, "invalid 'status', allowed: pending, succeeded, failed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	skip := int64((pagination.Page - 1) * pagination.PerPage)
+	list, total, err := StoreGetDeliveries(ctx, id, status, skip, int64(pagination.PerPage))
+	if err != nil {
+		logger.FromContext(ctx).Error("getting deliveries failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return
+	}
+	pagination.Total = int(total)
+
+	utils.WriteJSON(w, http.StatusOK, DeliveryListResponse{
+		Data: list,
+		Meta: DeliveryListMeta{Pagination: pagination},
+	})
+}
+
+// HandleReplayWebhook godoc
+// @Summary Replay failed deliveries
+// @Description Publishes webhook_replay_requested command. Events consumer sends every failed or stale pending delivery of the webhook again.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Webhook ID"
+// @Success 202 {object} webhook.ReplayResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/webhooks/{id}/replay [post]
+func HandleReplayWebhook(ch *amqp.Channel) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := getWebhook(w, r)
+		if !ok {
+			return
+		}
+		requestReplay(w, r, ch, hook.ID, primitive.NilObjectID)
+	}
+}
+
+// HandleReplayDelivery godoc
+// @Summary Replay failed delivery
+// @Description Publishes webhook_replay_requested command. Events consumer sends the delivery again. Delivery must be failed or pending without attempts for 15 minutes.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Webhook ID"
+// @Param delivery_id path string true "Delivery ID"
+// @Success 202 {object} webhook.ReplayResponse
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 401 {object} utils.ErrorResponse
+// @Failure 403 {object} utils.ErrorResponse
+// @Failure 404 {object} utils.ErrorResponse
+// @Failure 409 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Router /api/v1/admin/webhooks/{id}/deliveries/{delivery_id}/replay [post]
+func HandleReplayDelivery(ch *amqp.Channel) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deliveryID, err := primitive.ObjectIDFromHex(mux.Vars(r)["delivery_id"])
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, consts.ErrInvalidID)
+			return
+		}
+		hook, ok := getWebhook(w, r)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+		delivery, err := StoreGetDelivery(ctx, deliveryID)
+		if err != nil {
+			logger.FromContext(ctx).Error("getting delivery failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+			return
+		}
+		if delivery == nil || delivery.WebhookID != hook.ID {
+			utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+			return
+		}
+		if delivery.Status != StatusFailed && !delivery.stale(time.Now()) {
+			utils.WriteJSONError(w, http.StatusConflict, "only failed and stale pending deliveries can be replayed")
+			return
+		}
+		requestReplay(w, r, ch, hook.ID, delivery.ID)
+	}
+}
+
+// getWebhook reads webhook of the path. Error response is written if it's not found.
+func getWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusBadRequest, consts.ErrInvalidID)
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+	defer cancel()
+
+	hook, err := StoreGetWebhook(ctx, id)
+	if err != nil {
+		logger.FromContext(ctx).Error("getting webhook failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, consts.ErrDatabase)
+		return nil, false
+	}
+	if hook == nil {
+		utils.WriteJSONError(w, http.StatusNotFound, consts.ErrNotFound)
+		return nil, false
+	}
+	return hook, true
+}
+
+// requestReplay publishes replay command. Empty delivery ID replays every
+// failed delivery of the webhook.
+func requestReplay(w http.ResponseWriter, r *http.Request, ch *amqp.Channel, webhookID, deliveryID primitive.ObjectID) {
+	data := map[string]interface{}{"webhook_id": webhookID.Hex()}
+	if !deliveryID.IsZero() {
+		data["delivery_id"] = deliveryID.Hex()
+	}
+	event := events.Event{
+		CreatedAt:     time.Now(),
+		Type:          consts.EventWebhookReplayRequested,
+		CorrelationID: logger.RequestID(r.Context()),
+		ObjectID:      webhookID,
+		Data:          data,
+	}
+	if err := events.Publish(r.Context(), ch, &event); err != nil {
+		logger.FromContext(r.Context()).Error("publishing replay request failed", logger.FieldError, err)
+		utils.WriteJSONError(w, http.StatusInternalServerError, "could not request replay")
+		return
+	}
+	logger.FromContext(r.Context()).Info("webhook replay requested", "webhook", webhookID.Hex())
+	audit.Record(r, audit.ActionWebhookReplayed, webhookID, data)
+	utils.WriteJSON(w, http.StatusAccepted, ReplayResponse{Status: "requested"})
+}
+
+// ReplayIDs reads delivery and webhook IDs of a replay command
+func ReplayIDs(event *events.Event) (deliveryID, webhookID primitive.ObjectID, err error) {
+	if value, ok := event.Data["delivery_id"].(string); ok {
+		if deliveryID, err = primitive.ObjectIDFromHex(value); err != nil {
+			return
+		}
+	}
+	if value, ok := event.Data["webhook_id"].(string); ok {
+		if webhookID, err = primitive.ObjectIDFromHex(value); err != nil {
+			return
+		}
+	}
+	if deliveryID.IsZero() && webhookID.IsZero() {
+		err = errors.New("replay command has no delivery_id or webhook_id")
+	}
+	return
+}
+
+// validate checks input and sets default format
+func validate(input *WebhookInput) error {
+	input.URL = strings.TrimSpace(input.URL)
+	u, err := url.Parse(input.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(input.URL) > maxURLLength {
+		return errors.New("invalid 'url', must be an absolute http or https URL")
+	}
+	if blockedHost(u.Hostname()) {
+		return errors.New("invalid 'url', private and loopback addresses are not allowed")
+	}
+	if len(input.Types) == 0 {
+		return fmt.Errorf("'types' is required, allowed: %s", strings.Join(EventTypes, ", "))
+	}
+	seen := map[string]bool{}
+	for _, t := range input.Types {
+		if !contains(EventTypes, t) {
+			return fmt.Errorf("unknown type '%s', allowed: %s", t, strings.Join(EventTypes, ", "))
+		}
+		if seen[t] {
+			return fmt.Errorf("type '%s' is repeated", t)
+		}
+		seen[t] = true
+	}
+	if input.Format == "" {
+		input.Format = FormatJSON
+	}
+	if !contains(Formats, input.Format) {
+		return fmt.Errorf("invalid 'format', allowed: %s", strings.Join(Formats, ", "))
+	}
+	if input.Secret != "" && (len(input.Secret) < minSecretLength || len(input.Secret) > maxSecretLength) {
+		return fmt.Errorf("'secret' must be %d-%d characters", minSecretLength, maxSecretLength)
+	}
+	return nil
+}
+
+// generateSecret returns 32 random bytes as hex
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
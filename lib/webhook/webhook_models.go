@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/utils"
+)
+
+// Payload formats
+const (
+	FormatJSON    = "json"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+)
+
+// Formats are all payload formats
+var Formats = []string{FormatJSON, FormatSlack, FormatDiscord}
+
+// EventTypes can be subscribed to. Commands and internal events are not sent.
+var EventTypes = []string{
+	consts.EventJobCompleted,
+	consts.EventJobFailed,
+	consts.EventTrafficSpike,
+	consts.EventDailySummary,
+	consts.EventRepoAdded,
+	consts.EventRepoRemoved,
+	consts.EventUserCreated,
+}
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Webhook is a subscription of an HTTP endpoint to event types
+type Webhook struct {
+	ID  primitive.ObjectID `bson:"_id" json:"id"`
+	URL string             `bson:"url" json:"url"`
+	// Secret signs payloads, it's shown only when the webhook is created
+	Secret    string     `bson:"secret" json:"-"`
+	Types     []string   `bson:"types" json:"types"`
+	Format    string     `bson:"format" json:"format"`
+	CreatedBy string     `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"-"`
+}
+
+// WebhookInput is body of 'POST /api/v1/admin/webhooks'
+type WebhookInput struct {
+	URL   string   `json:"url"`
+	Types []string `json:"types"`
+	// Format is json, slack or discord. Default is json.
+	Format string `json:"format"`
+	// Secret is generated when empty
+	Secret string `json:"secret"`
+}
+
+// CreatedWebhook is the only response that has the secret
+type CreatedWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// Delivery is one event sent to one webhook
+type Delivery struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	WebhookID primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+	EventID   primitive.ObjectID `bson:"event_id,omitempty" json:"event_id,omitempty"`
+	EventType string             `bson:"event_type" json:"event_type"`
+	// Payload is the body, replays send it again
+	Payload   string    `bson:"payload" json:"payload"`
+	Status    string    `bson:"status" json:"status"`
+	Attempts  []Attempt `bson:"attempts" json:"attempts"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// UpdatedAt is time of the next attempt while delivery waits for a retry,
+	// so a delivery that is still retrying is never stale
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// stale tells if delivery has been pending so long that its worker must have died
+func (d *Delivery) stale(now time.Time) bool {
+	return d.Status == StatusPending && d.UpdatedAt.Before(now.Add(-staleAge))
+}
+
+// Attempt is one HTTP request of a delivery
+type Attempt struct {
+	At         time.Time `bson:"at" json:"at"`
+	StatusCode int       `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	DurationMs int64     `bson:"duration_ms" json:"duration_ms"`
+}
+
+// DeliveryListMeta is returned with list of deliveries
+type DeliveryListMeta struct {
+	Pagination utils.Pagination `json:"pagination"`
+}
+
+// DeliveryListResponse is response of 'GET /api/v1/admin/webhooks/{id}/deliveries'
+type DeliveryListResponse struct {
+	Data []Delivery       `json:"data"`
+	Meta DeliveryListMeta `json:"meta"`
+}
+
+// ReplayResponse is response of replay endpoints
+type ReplayResponse struct {
+	Status string `json:"status"`
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
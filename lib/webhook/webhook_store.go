@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/store"
+)
+
+var notDeleted = bson.M{"$exists": false}
+
+func webhooks() *mongo.Collection {
+	return store.GetClient().Database(consts.DatabaseName).Collection(consts.CollectionWebhooks)
+}
+
+func deliveries() *mongo.Collection {
+	return store.GetClient().Database(consts.DatabaseName).Collection(consts.CollectionDeliveries)
+}
+
+// StoreCreateWebhook saves new webhook
+func StoreCreateWebhook(ctx context.Context, hook *Webhook) error {
+	_, err := webhooks().InsertOne(ctx, hook)
+	return err
+}
+
+// StoreGetWebhook returns webhook that is not deleted, nil if not found
+func StoreGetWebhook(ctx context.Context, id primitive.ObjectID) (*Webhook, error) {
+	hook := &Webhook{}
+	err := webhooks().FindOne(ctx, bson.M{"_id": id, "deleted_at": notDeleted}).Decode(hook)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// StoreGetWebhooks returns webhooks that are not deleted, newest first. Only
+// webhooks subscribed to eventType if it's not empty.
+func StoreGetWebhooks(ctx context.Context, eventType string) ([]Webhook, error) {
+	filter := bson.M{"deleted_at": notDeleted}
+	if eventType != "" {
+		filter["types"] = eventType
+	}
+	cursor, err := webhooks().Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]Webhook, 0)
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// StoreDeleteWebhook marks webhook deleted so its deliveries stay readable.
+// Returns false if it was not found.
+func StoreDeleteWebhook(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	res, err := webhooks().UpdateOne(ctx,
+		bson.M{"_id": id, "deleted_at": notDeleted},
+		bson.M{"$set": bson.M{"deleted_at": time.Now().UTC()}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// StoreCreateDelivery saves new delivery
+func StoreCreateDelivery(ctx context.Context, delivery *Delivery) error {
+	_, err := deliveries().InsertOne(ctx, delivery)
+	return err
+}
+
+// StoreGetDelivery returns delivery, nil if not found
+func StoreGetDelivery(ctx context.Context, id primitive.ObjectID) (*Delivery, error) {
+	delivery := &Delivery{}
+	err := deliveries().FindOne(ctx, bson.M{"_id": id}).Decode(delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// StoreAddAttempt appends attempt to delivery and sets its status and update time
+func StoreAddAttempt(ctx context.Context, id primitive.ObjectID, attempt Attempt, status string, updatedAt time.Time) error {
+	_, err := deliveries().UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$push": bson.M{"attempts": attempt},
+		"$set":  bson.M{"status": status, "updated_at": updatedAt},
+	})
+	return err
+}
+
+// StoreResetFailed marks failed deliveries and pending ones not updated since
+// staleBefore pending again and returns IDs of those. Either one delivery or
+// all of a webhook are reset.
+func StoreResetFailed(ctx context.Context, deliveryID, webhookID primitive.ObjectID, staleBefore time.Time) ([]primitive.ObjectID, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": StatusFailed},
+		bson.M{"status": StatusPending, "updated_at": bson.M{"$lt": staleBefore}},
+	}}
+	if !deliveryID.IsZero() {
+		filter["_id"] = deliveryID
+	}
+	if !webhookID.IsZero() {
+		filter["webhook_id"] = webhookID
+	}
+	return claimDeliveries(ctx, filter)
+}
+
+// StoreResetStale marks pending deliveries not updated since staleBefore pending
+// again and returns IDs of those. Those were left pending by a process that died.
+func StoreResetStale(ctx context.Context, staleBefore time.Time) ([]primitive.ObjectID, error) {
+	return claimDeliveries(ctx, bson.M{"status": StatusPending, "updated_at": bson.M{"$lt": staleBefore}})
+}
+
+// claimDeliveries resets deliveries matching filter one by one and returns IDs
+// of those this call reset. Delivery that was reset by someone else meanwhile
+// doesn't match anymore, so it's sent only once.
+func claimDeliveries(ctx context.Context, filter bson.M) ([]primitive.ObjectID, error) {
+	cursor, err := deliveries().Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Delivery, 0)
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(list))
+	for _, d := range list {
+		claim := bson.M{"_id": d.ID}
+		for key, value := range filter {
+			if key != "_id" {
+				claim[key] = value
+			}
+		}
+		res, err := deliveries().UpdateOne(ctx, claim, bson.M{"$set": bson.M{"status": StatusPending, "updated_at": time.Now().UTC()}})
+		if err != nil {
+			return ids, err
+		}
+		if res.ModifiedCount == 1 {
+			ids = append(ids, d.ID)
+		}
+	}
+	return ids, nil
+}
+
+// StoreGetDeliveries returns newest deliveries of webhook and total count of them.
+// All statuses if status is empty.
+func StoreGetDeliveries(ctx context.Context, webhookID primitive.ObjectID, status string, skip, limit int64) ([]Delivery, int64, error) {
+	filter := bson.M{"webhook_id": webhookID}
+	if status != "" {
+		filter["status"] = status
+	}
+	total, err := deliveries().CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(limit)
+	cursor, err := deliveries().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	list := make([]Delivery, 0)
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, 0, err
+	}
+	return list, total, nil
+}
@@ -0,0 +1,268 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/store"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"a":1}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", 1700000000, []byte(`{"a":1}`))
+	if got != "49f24e537407743fa4a0242bb63b94b9a47ee99cbbe071ccd8a22550ae411686" {
+		t.Error(got)
+	}
+	if Sign("other", 1700000000, []byte(`{"a":1}`)) == got || Sign("secret", 1700000001, []byte(`{"a":1}`)) == got {
+		t.Error("signature should depend on secret and timestamp")
+	}
+}
+
+func TestPayload(t *testing.T) {
+	event := events.Event{
+		ID:        primitive.NewObjectID(),
+		Type:      consts.EventTrafficSpike,
+		CreatedAt: time.Date(2021, 11, 20, 8, 0, 0, 0, time.UTC),
+		Data:      map[string]interface{}{"repo": "devops-app", "views": 120, "date": "2021-11-19", "average": 10.0},
+	}
+	body, err := Payload(FormatJSON, event, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := EventPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != event.ID.Hex() || payload.Title != "Traffic spike in devops-app" || payload.Link != "https://example.com/api/v1/repos/devops-app/traffic" || payload.Data["repo"] != "devops-app" {
+		t.Errorf("%+v", payload)
+	}
+
+	for format, key := range map[string]string{FormatSlack: "text", FormatDiscord: "content"} {
+		body, err := Payload(format, event, "https://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := map[string]string{}
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(message[key], "*Traffic spike in devops-app*\n120 views") {
+			t.Errorf("%s: %q", format, message[key])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() WebhookInput {
+		return WebhookInput{URL: "https://hooks.slack.com/services/x", Types: []string{consts.EventJobFailed}}
+	}
+	input := valid()
+	if err := validate(&input); err != nil || input.Format != FormatJSON {
+		t.Error(err, input.Format)
+	}
+
+	invalid := []func(*WebhookInput){
+		func(i *WebhookInput) { i.URL = "ftp://example.com" },
+		func(i *WebhookInput) { i.URL = "/relative" },
+		func(i *WebhookInput) { i.URL = "http://localhost:8080/hook" },
+		func(i *WebhookInput) { i.URL = "http://127.0.0.1/hook" },
+		func(i *WebhookInput) { i.URL = "http://169.254.169.254/latest/meta-data" },
+		func(i *WebhookInput) { i.URL = "http://[::1]:9100/metrics" },
+		func(i *WebhookInput) { i.URL = "http://10.0.0.5/hook" },
+		func(i *WebhookInput) { i.Types = nil },
+		func(i *WebhookInput) { i.Types = []string{consts.EventTrafficJobRequested} },
+		func(i *WebhookInput) { i.Types = []string{consts.EventJobFailed, consts.EventJobFailed} },
+		func(i *WebhookInput) { i.Format = "xml" },
+		func(i *WebhookInput) { i.Secret = "short" },
+	}
+	for i, change := range invalid {
+		input := valid()
+		change(&input)
+		if err := validate(&input); err == nil {
+			t.Errorf("case %d should be invalid", i)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	for ip, blocked := range map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.20.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"8.8.8.8":         false,
+		"2606:4700::1111": false,
+	} {
+		if blockedIP(net.ParseIP(ip)) != blocked {
+			t.Error(ip, "expected blocked", blocked)
+		}
+	}
+
+	// Test server listens on loopback, so it can't be reached
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+	}))
+	defer endpoint.Close()
+	client := newClient(time.Second)
+	if _, err := client.Post(endpoint.URL, "application/json", nil); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Error("loopback should be refused", err)
+	}
+
+	// Redirects are not followed
+	client.Transport = http.DefaultTransport
+	res, err := client.Post(endpoint.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Error("redirect should be the response, got", res.StatusCode)
+	}
+}
+
+func TestSendDuration(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer endpoint.Close()
+
+	hook := &Webhook{URL: endpoint.URL, Secret: "secret"}
+	delivery := &Delivery{ID: primitive.NewObjectID(), EventType: "test", Payload: "{}"}
+	attempt := send(context.Background(), endpoint.Client(), hook, delivery)
+	if attempt.StatusCode != http.StatusOK || attempt.Error != "" {
+		t.Fatal("send failed", attempt)
+	}
+	if attempt.DurationMs < 20 {
+		t.Error("duration was not recorded", attempt.DurationMs)
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	teardown := store.SetupTest(t)
+	defer teardown()
+	ctx := context.Background()
+
+	// Fails once with 503, then succeeds until broken is set
+	var calls, broken int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if r.Header.Get(HeaderSignature) != "sha256="+Sign("0123456789abcdef", timestamp, body.Bytes()) {
+			t.Error("invalid signature")
+		}
+		if r.Header.Get(HeaderEvent) != consts.EventJobFailed {
+			t.Error(r.Header.Get(HeaderEvent))
+		}
+		switch {
+		case atomic.AddInt32(&calls, 1) == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case atomic.LoadInt32(&broken) == 1:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer endpoint.Close()
+
+	hook := &Webhook{ID: primitive.NewObjectID(), URL: endpoint.URL, Secret: "0123456789abcdef", Types: []string{consts.EventJobFailed}, Format: FormatJSON}
+	other := &Webhook{ID: primitive.NewObjectID(), URL: endpoint.URL, Secret: "0123456789abcdef", Types: []string{consts.EventJobCompleted}, Format: FormatJSON}
+	for _, h := range []*Webhook{hook, other} {
+		if err := StoreCreateWebhook(ctx, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event := events.Event{ID: primitive.NewObjectID(), Type: consts.EventJobFailed, Data: map[string]interface{}{"job": consts.JobGithubTraffic}}
+	run := func(dispatch func(w *Worker)) {
+		w := &Worker{Client: endpoint.Client(), Retries: 2, RetryDelay: time.Millisecond * 10, Workers: 2}
+		w.Start()
+		dispatch(w)
+		if !w.Stop(ctx) {
+			t.Fatal("stop interrupted deliveries")
+		}
+	}
+	deliveries := func(status string) []Delivery {
+		list, _, err := StoreGetDeliveries(ctx, hook.ID, status, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	// Retried after 503
+	run(func(w *Worker) {
+		if err := w.Dispatch(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	})
+	list := deliveries("")
+	if len(list) != 1 || list[0].Status != StatusSucceeded || len(list[0].Attempts) != 2 || list[0].Attempts[0].StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("%+v", list)
+	}
+	if others, _, _ := StoreGetDeliveries(ctx, other.ID, "", 0, 10); len(others) != 0 {
+		t.Error("webhook of other type got delivery")
+	}
+
+	// 400 is not retried
+	atomic.StoreInt32(&broken, 1)
+	run(func(w *Worker) {
+		if err := w.Dispatch(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	})
+	failed := deliveries(StatusFailed)
+	if len(failed) != 1 || len(failed[0].Attempts) != 1 {
+		t.Fatalf("%+v", failed)
+	}
+
+	// Replay sends failed deliveries again
+	atomic.StoreInt32(&broken, 0)
+	run(func(w *Worker) {
+		count, err := w.Replay(ctx, primitive.NilObjectID, hook.ID)
+		if err != nil || count != 1 {
+			t.Fatal(count, err)
+		}
+	})
+	if failed := deliveries(StatusFailed); len(failed) != 0 {
+		t.Errorf("%+v", failed)
+	}
+	if list := deliveries(StatusSucceeded); len(list) != 2 {
+		t.Errorf("%+v", list)
+	}
+
+	// Pending delivery left by a dead process is resumed once, fresh one is left alone
+	old := time.Now().UTC().Add(-staleAge * 2)
+	for _, updated := range []time.Time{old, time.Now().UTC()} {
+		delivery := &Delivery{ID: primitive.NewObjectID(), WebhookID: hook.ID, EventType: consts.EventJobFailed, Payload: "{}", Status: StatusPending, Attempts: []Attempt{}, CreatedAt: updated, UpdatedAt: updated}
+		if err := StoreCreateDelivery(ctx, delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(func(w *Worker) {
+		if count, err := w.ResumeStale(ctx); err != nil || count != 1 {
+			t.Fatal(count, err)
+		}
+		if count, err := w.ResumeStale(ctx); err != nil || count != 0 {
+			t.Error("delivery should be claimed only once", count, err)
+		}
+	})
+	if list := deliveries(StatusSucceeded); len(list) != 3 {
+		t.Errorf("%+v", list)
+	}
+}
@@ -0,0 +1,287 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/feed"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+	"miikka.xyz/devops-app/utils"
+)
+
+// queueSize is how many deliveries wait for a free worker. Deliveries that
+// don't fit are marked failed and can be replayed.
+const queueSize = 1000
+
+// staleAge is how long a pending delivery can go without an attempt before it's
+// considered left behind by a process that died. Waits between retries don't
+// count, updated_at is set to the next attempt, so this covers one request.
+const staleAge = 15 * time.Minute
+
+// Worker sends deliveries in background
+type Worker struct {
+	Client *http.Client
+	// Retries is how many times failed request is sent again
+	Retries int
+	// RetryDelay is doubled after each failed attempt
+	RetryDelay time.Duration
+	// Workers is how many deliveries are sent at the same time
+	Workers int
+
+	queue  chan primitive.ObjectID
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// mu guards closing the queue
+	mu     sync.RWMutex
+	closed bool
+}
+
+// WorkerFromEnv returns worker configured by WEBHOOK_WORKERS, WEBHOOK_RETRIES,
+// WEBHOOK_RETRY_DELAY and WEBHOOK_TIMEOUT
+func WorkerFromEnv() *Worker {
+	workers, err := strconv.Atoi(utils.GetEnv("WEBHOOK_WORKERS", "4"))
+	if err != nil || workers < 1 {
+		logger.Warn("invalid WEBHOOK_WORKERS, using default", "value", utils.GetEnv("WEBHOOK_WORKERS", ""))
+		workers = 4
+	}
+	retries, err := strconv.Atoi(utils.GetEnv("WEBHOOK_RETRIES", "3"))
+	if err != nil || retries < 0 {
+		logger.Warn("invalid WEBHOOK_RETRIES, using default", "value", utils.GetEnv("WEBHOOK_RETRIES", ""))
+		retries = 3
+	}
+	return &Worker{
+		Client:     newClient(utils.GetEnvDuration("WEBHOOK_TIMEOUT", time.Second*10)),
+		Retries:    retries,
+		RetryDelay: utils.GetEnvDuration("WEBHOOK_RETRY_DELAY", time.Second*5),
+		Workers:    workers,
+	}
+}
+
+// Start starts workers
+func (w *Worker) Start() {
+	w.queue = make(chan primitive.ObjectID, queueSize)
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	for i := 0; i < w.Workers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for id := range w.queue {
+				w.process(id)
+			}
+		}()
+	}
+	logger.Info("webhook workers started", "workers", w.Workers)
+}
+
+// Stop stops accepting deliveries and waits for queued ones. When ctx ends
+// before that, deliveries are interrupted and marked failed. Returns false if
+// deliveries were interrupted.
+func (w *Worker) Stop(ctx context.Context) bool {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		w.cancel()
+		return true
+	case <-ctx.Done():
+	}
+	w.cancel()
+	<-done
+	return false
+}
+
+// Dispatch creates deliveries of event for webhooks subscribed to its type.
+// Webhook that fails doesn't stop deliveries of the others, error tells how
+// many failed.
+func (w *Worker) Dispatch(ctx context.Context, event events.Event) error {
+	hooks, err := StoreGetWebhooks(ctx, event.Type)
+	if err != nil {
+		return err
+	}
+	log := logger.FromContext(ctx)
+	baseURL := feed.PublicURL()
+	var lastErr error
+	failed := 0
+	for _, hook := range hooks {
+		payload, err := Payload(hook.Format, event, baseURL)
+		if err != nil {
+			log.Error("building webhook payload failed", "webhook", hook.ID.Hex(), logger.FieldError, err)
+			lastErr = err
+			failed++
+			continue
+		}
+		now := time.Now().UTC()
+		delivery := &Delivery{
+			ID:        primitive.NewObjectID(),
+			WebhookID: hook.ID,
+			EventID:   event.ID,
+			EventType: event.Type,
+			Payload:   string(payload),
+			Status:    StatusPending,
+			Attempts:  []Attempt{},
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := StoreCreateDelivery(ctx, delivery); err != nil {
+			log.Error("saving webhook delivery failed", "webhook", hook.ID.Hex(), logger.FieldError, err)
+			lastErr = err
+			failed++
+			continue
+		}
+		w.enqueue(ctx, delivery.ID)
+	}
+	if len(hooks) > failed {
+		log.Info("webhook deliveries created", "webhooks", len(hooks)-failed)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%d of %d webhook deliveries failed: %v", failed, len(hooks), lastErr)
+	}
+	return nil
+}
+
+// Replay sends failed and stale pending deliveries again. Either one delivery
+// or every such delivery of webhook is replayed. Returns how many were queued.
+func (w *Worker) Replay(ctx context.Context, deliveryID, webhookID primitive.ObjectID) (int, error) {
+	ids, err := StoreResetFailed(ctx, deliveryID, webhookID, time.Now().Add(-staleAge))
+	for _, id := range ids {
+		w.enqueue(ctx, id)
+	}
+	if err != nil {
+		return len(ids), err
+	}
+	logger.FromContext(ctx).Info("webhook deliveries replayed", "count", len(ids))
+	return len(ids), nil
+}
+
+// ResumeStale sends pending deliveries that were left behind by a process that
+// died. Events consumer calls this on start. Returns how many were queued.
+func (w *Worker) ResumeStale(ctx context.Context) (int, error) {
+	ids, err := StoreResetStale(ctx, time.Now().Add(-staleAge))
+	for _, id := range ids {
+		w.enqueue(ctx, id)
+	}
+	if len(ids) > 0 {
+		logger.FromContext(ctx).Info("stale webhook deliveries resumed", "count", len(ids))
+	}
+	return len(ids), err
+}
+
+// enqueue queues delivery or marks it failed if queue is full or closed
+func (w *Worker) enqueue(ctx context.Context, id primitive.ObjectID) {
+	w.mu.RLock()
+	queued := false
+	if !w.closed {
+		select {
+		case w.queue <- id:
+			queued = true
+		default:
+		}
+	}
+	w.mu.RUnlock()
+	if queued {
+		return
+	}
+	logger.FromContext(ctx).Warn("webhook queue full, delivery failed", "delivery", id.Hex())
+	w.fail(id, "delivery queue was full")
+}
+
+// process sends delivery until it succeeds, fails permanently or retries run out
+func (w *Worker) process(id primitive.ObjectID) {
+	log := logger.With("delivery", id.Hex())
+	if w.ctx.Err() != nil {
+		w.fail(id, "interrupted by shutdown")
+		return
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, time.Second*10)
+	delivery, err := StoreGetDelivery(ctx, id)
+	var hook *Webhook
+	if err == nil && delivery != nil {
+		hook, err = StoreGetWebhook(ctx, delivery.WebhookID)
+	}
+	cancel()
+	if err != nil {
+		log.Error("reading delivery failed", logger.FieldError, err)
+		w.fail(id, "reading delivery failed")
+		return
+	}
+	if delivery == nil {
+		log.Warn("delivery not found")
+		return
+	}
+	if hook == nil {
+		w.fail(id, "webhook was deleted")
+		return
+	}
+	log = log.With("webhook", hook.ID.Hex(), "type", delivery.EventType)
+
+	delay := w.RetryDelay
+	for i := 0; ; i++ {
+		attempt := send(w.ctx, w.Client, hook, delivery)
+		metrics.WebhookAttempts.Observe(float64(attempt.DurationMs) / 1000)
+		status := StatusPending
+		updatedAt := attempt.At
+		switch {
+		case succeeded(attempt):
+			status = StatusSucceeded
+		case i >= w.Retries || !retryable(attempt) || w.ctx.Err() != nil:
+			status = StatusFailed
+		default:
+			updatedAt = time.Now().UTC().Add(delay)
+		}
+		if err := w.record(id, attempt, status, updatedAt); err != nil {
+			log.Error("recording delivery attempt failed", logger.FieldError, err)
+		}
+		if status == StatusSucceeded {
+			log.Info("webhook delivered", "attempts", i+1)
+			metrics.WebhookDeliveries.WithLabelValues(StatusSucceeded).Inc()
+			return
+		}
+		if status == StatusFailed {
+			log.Warn("webhook delivery failed", "attempts", i+1, "status_code", attempt.StatusCode, logger.FieldError, attempt.Error)
+			metrics.WebhookDeliveries.WithLabelValues(StatusFailed).Inc()
+			return
+		}
+		log.Warn("webhook attempt failed, retrying", "attempt", i+1, "retry_in", delay.String(), logger.FieldError, attempt.Error)
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			w.fail(id, "interrupted by shutdown")
+			return
+		}
+		delay *= 2
+	}
+}
+
+// record saves attempt. Worker context may already be canceled, so own one is used.
+func (w *Worker) record(id primitive.ObjectID, attempt Attempt, status string, updatedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return StoreAddAttempt(ctx, id, attempt, status, updatedAt)
+}
+
+// fail marks delivery failed with a reason that is not a response of the endpoint
+func (w *Worker) fail(id primitive.ObjectID, reason string) {
+	now := time.Now().UTC()
+	if err := w.record(id, Attempt{At: now, Error: reason}, StatusFailed, now); err != nil {
+		logger.Error("marking delivery failed failed", "delivery", id.Hex(), logger.FieldError, err)
+	}
+	metrics.WebhookDeliveries.WithLabelValues(StatusFailed).Inc()
+}
@@ -0,0 +1,206 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log entry
+type Level int
+
+// Levels from least to most severe
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// Common field names
+const (
+	FieldRequestID     = "request_id"
+	FieldRunID         = "run_id"
+	FieldEventID       = "event_id"
+	FieldCorrelationID = "correlation_id"
+	FieldError         = "error"
+)
+
+var (
+	mu    sync.Mutex
+	out   io.Writer = os.Stdout
+	level           = LevelInfo
+	root            = &Logger{}
+)
+
+func init() {
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := SetLevelName(value); err != nil {
+			root.Warn("invalid LOG_LEVEL, using info", FieldError, err)
+		}
+	}
+}
+
+// Logger writes JSON lines. Fields are added to every entry.
+type Logger struct {
+	fields []interface{}
+}
+
+// SetLevel sets minimum level that is written
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// SetLevelName sets level by name: debug, info, warn or error
+func SetLevelName(name string) error {
+	for l, n := range levelNames {
+		if n == strings.ToLower(strings.TrimSpace(name)) {
+			SetLevel(l)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level '%s'", name)
+}
+
+// SetOutput changes where logs are written, used in tests
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// With returns logger which adds key-value pairs to every entry
+func With(keyValues ...interface{}) *Logger {
+	return root.With(keyValues...)
+}
+
+// With returns logger which adds key-value pairs to every entry
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyValues ...interface{}) { l.write(LevelDebug, msg, keyValues) }
+func (l *Logger) Info(msg string, keyValues ...interface{})  { l.write(LevelInfo, msg, keyValues) }
+func (l *Logger) Warn(msg string, keyValues ...interface{})  { l.write(LevelWarn, msg, keyValues) }
+func (l *Logger) Error(msg string, keyValues ...interface{}) { l.write(LevelError, msg, keyValues) }
+
+// Fatal logs with error level and exits
+func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
+	l.write(LevelError, msg, keyValues)
+	os.Exit(1)
+}
+
+func Debug(msg string, keyValues ...interface{}) { root.write(LevelDebug, msg, keyValues) }
+func Info(msg string, keyValues ...interface{})  { root.write(LevelInfo, msg, keyValues) }
+func Warn(msg string, keyValues ...interface{})  { root.write(LevelWarn, msg, keyValues) }
+func Error(msg string, keyValues ...interface{}) { root.write(LevelError, msg, keyValues) }
+
+// Fatal logs with error level and exits
+func Fatal(msg string, keyValues ...interface{}) {
+	root.write(LevelError, msg, keyValues)
+	os.Exit(1)
+}
+
+func (l *Logger) write(lvl Level, msg string, keyValues []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if lvl < level {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[lvl],
+		"msg":   msg,
+	}
+	addFields(entry, l.fields)
+	addFields(entry, keyValues)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","msg":"marshaling log entry failed","error":%q}`, err.Error()))
+	}
+	out.Write(append(data, '\n'))
+}
+
+// addFields adds key-value pairs to entry. Errors are written as strings because
+// most of them would be marshaled to empty objects.
+func addFields(entry map[string]interface{}, keyValues []interface{}) {
+	for i := 0; i < len(keyValues); i += 2 {
+		key := fmt.Sprint(keyValues[i])
+		if i+1 >= len(keyValues) {
+			entry[key] = nil
+			break
+		}
+		switch value := keyValues[i+1].(type) {
+		case error:
+			entry[key] = value.Error()
+		case fmt.Stringer:
+			entry[key] = value.String()
+		default:
+			entry[key] = value
+		}
+	}
+}
+
+// NewID returns random hex ID used as request and job run ID
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+type contextKey struct{}
+
+type loggerKey struct{}
+
+// WithRequestID returns context which carries the ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// RequestID returns ID from context or empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// NewContext returns context which carries the logger. Used by jobs so every
+// function of the run logs with the run ID.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns logger of the context or the root logger. Request ID of
+// the context is added to every entry.
+func FromContext(ctx context.Context) *Logger {
+	l, ok := ctx.Value(loggerKey{}).(*Logger)
+	if !ok {
+		l = root
+	}
+	if id := RequestID(ctx); id != "" {
+		return l.With(FieldRequestID, id)
+	}
+	return l
+}
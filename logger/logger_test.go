@@ -0,0 +1,93 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func readEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	entries := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal("invalid JSON line", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLevelsAndFields(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LevelInfo)
+
+	Debug("hidden")
+	With(FieldRunID, "abc").Error("failed", FieldError, errors.New("boom"), "count", 2)
+
+	entries := readEntries(t, &buf)
+	if len(entries) != 1 {
+		t.Fatal("expected one entry, got", len(entries))
+	}
+	entry := entries[0]
+	if entry["level"] != "error" || entry["msg"] != "failed" {
+		t.Error("wrong level or message", entry)
+	}
+	if entry[FieldRunID] != "abc" || entry[FieldError] != "boom" || entry["count"] != 2.0 {
+		t.Error("wrong fields", entry)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LevelDebug)
+	defer SetLevel(LevelInfo)
+
+	var idInHandler string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idInHandler = RequestID(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderRequestID, "client-id")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if idInHandler != "client-id" || rec.Header().Get(HeaderRequestID) != "client-id" {
+		t.Error("client request ID was not used", idInHandler)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(idInHandler) != 32 || rec.Header().Get(HeaderRequestID) != idInHandler {
+		t.Error("request ID was not generated", idInHandler)
+	}
+
+	entries := readEntries(t, &buf)
+	if len(entries) != 2 || entries[0][FieldRequestID] != "client-id" {
+		t.Error("request was not logged with ID", entries)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+
+	ctx := NewContext(context.Background(), With(FieldRunID, "run"))
+	ctx = WithRequestID(ctx, "req")
+	FromContext(ctx).Info("hello")
+
+	entry := readEntries(t, &buf)[0]
+	if entry[FieldRunID] != "run" || entry[FieldRequestID] != "req" {
+		t.Error("context fields missing", entry)
+	}
+}
@@ -0,0 +1,34 @@
+package logger
+
+import (
+	"net/http"
+	"time"
+)
+
+// HeaderRequestID is read from incoming requests and written to responses
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength limits IDs coming from clients
+const maxRequestIDLength = 64
+
+// Middleware puts request ID to request context and logs every request. ID
+// is taken from X-Request-ID header when client or proxy has set it.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(HeaderRequestID)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = NewID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		ctx := WithRequestID(r.Context(), id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		FromContext(ctx).Debug("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
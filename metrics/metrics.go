@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+const namespace = "devops_app"
+
+// HTTP
+var (
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route, method and status",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+// Cache
+var (
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache reads by window and result (hit or miss)",
+	}, []string{"window", "result"})
+
+	CachePayloadBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_payload_bytes",
+		Help:      "Size of the last value written to cache key",
+	}, []string{"key", "codec"})
+)
+
+// Jobs
+var (
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Duration of job runs by job and status",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"job", "status"})
+
+	JobReposProcessed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_repos_processed",
+		Help:      "Repositories processed during the last run",
+	}, []string{"job"})
+
+	GithubRateLimitRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Remaining GitHub API requests in current rate limit window",
+	})
+)
+
+// Events
+var (
+	EventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_published_total",
+		Help:      "Events published to queue by type",
+	}, []string{"type"})
+
+	EventsConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_consumed_total",
+		Help:      "Events consumed from queue by type and result",
+	}, []string{"type", "result"})
+)
+
+// Scheduler
+var (
+	SchedulerRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduler_runs_total",
+		Help:      "Scheduled task runs by task and result (success, failure or skipped)",
+	}, []string{"task", "result"})
+
+	SchedulerLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scheduler_leader",
+		Help:      "1 when this scheduler instance is the leader",
+	})
+)
+
+// Live dashboard
+var (
+	WebSocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Open dashboard WebSocket connections",
+	})
+
+	WebSocketDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_dropped_total",
+		Help:      "Dashboard WebSocket connections refused or closed by reason (limit or slow)",
+	}, []string{"reason"})
+)
+
+// Webhooks
+var (
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries by result (succeeded or failed)",
+	}, []string{"result"})
+
+	WebhookAttempts = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webhook_attempt_duration_seconds",
+		Help:      "Duration of webhook HTTP requests",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+// Handler serves metrics of default registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Listen serves '/metrics' in background. Used by binaries without HTTP server.
+func Listen(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		logger.Info("metrics listening", "port", port)
+		if err := http.ListenAndServe("0.0.0.0:"+port, mux); err != nil {
+			logger.Error("metrics listener failed", logger.FieldError, err)
+		}
+	}()
+}
+
+// Push pushes metrics to Pushgateway if PUSHGATEWAY_URL is set. Used by short-lived jobs.
+func Push(job string) error {
+	url := utils.GetEnv("PUSHGATEWAY_URL", "")
+	if url == "" {
+		return nil
+	}
+	return push.New(url, job).Gatherer(prometheus.DefaultGatherer).Push()
+}
+
+// Middleware records duration and status of requests by route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		HTTPRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers status code. Flushing and hijacking are passed through
+// so streaming responses keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+)
+
+// Redis keys
+const (
+	keyLeader  = "scheduler:leader"
+	keyLastRun = "scheduler:last_run:"
+)
+
+// renewScript extends the lock only if this instance still holds it
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseScript deletes the lock only if this instance holds it
+var releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// RedisElector elects a leader with a lock key that expires. If the leader dies,
+// another replica takes the lock within TTL.
+type RedisElector struct {
+	client redis.UniversalClient
+	id     string
+	ttl    time.Duration
+	leader int32
+}
+
+// NewRedisElector returns elector with unique ID of this instance
+func NewRedisElector(client redis.UniversalClient, ttl time.Duration) *RedisElector {
+	host, _ := os.Hostname()
+	return &RedisElector{
+		client: client,
+		id:     host + "-" + logger.NewID(),
+		ttl:    ttl,
+	}
+}
+
+// IsLeader reports whether this instance holds the lock
+func (e *RedisElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// Run tries to get or renew the lock until ctx is done. Lock is released on return,
+// so next replica can take over right away.
+func (e *RedisElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *RedisElector) campaign(ctx context.Context) {
+	var leader bool
+	var err error
+	if e.IsLeader() {
+		var renewed int64
+		renewed, err = renewScript.Run(ctx, e.client, []string{keyLeader}, e.id, e.ttl.Milliseconds()).Int64()
+		leader = renewed == 1
+	} else {
+		leader, err = e.client.SetNX(ctx, keyLeader, e.id, e.ttl).Result()
+	}
+	// Leadership is given up on errors, because lock might expire meanwhile
+	if err != nil {
+		logger.Warn("leader election failed", logger.FieldError, err)
+		leader = false
+	}
+	e.setLeader(leader)
+}
+
+func (e *RedisElector) setLeader(leader bool) {
+	value := int32(0)
+	if leader {
+		value = 1
+	}
+	if atomic.SwapInt32(&e.leader, value) != value {
+		logger.Info("leadership changed", "leader", leader, "id", e.id)
+	}
+	metrics.SchedulerLeader.Set(float64(value))
+}
+
+func (e *RedisElector) release() {
+	if !e.IsLeader() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := releaseScript.Run(ctx, e.client, []string{keyLeader}, e.id).Err(); err != nil {
+		logger.Warn("releasing leader lock failed", logger.FieldError, err)
+	}
+	e.setLeader(false)
+}
+
+// RedisState saves last runs to redis, so every replica sees them
+type RedisState struct {
+	Client redis.UniversalClient
+}
+
+// LastRun returns zero time if task has never been run
+func (s RedisState) LastRun(ctx context.Context, task string) (time.Time, error) {
+	value, err := s.Client.Get(ctx, keyLastRun+task).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func (s RedisState) SetLastRun(ctx context.Context, task string, t time.Time) error {
+	return s.Client.Set(ctx, keyLastRun+task, t.UTC().Format(time.RFC3339Nano), 0).Err()
+}
@@ -0,0 +1,280 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+	"miikka.xyz/devops-app/tracing"
+)
+
+// Catch-up policies tell what to do when scheduled runs were missed, for example
+// because no replica was running
+const (
+	// CatchUpSkip waits for the next scheduled time
+	CatchUpSkip = "skip"
+	// CatchUpOnce runs once right away no matter how many runs were missed
+	CatchUpOnce = "once"
+)
+
+// parser accepts standard 5 field expressions and descriptors like '@hourly'
+var parser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Task is a function that is run on a cron schedule
+type Task struct {
+	Name string
+	// Schedule is a cron expression like '0 * * * *'
+	Schedule string
+	Run      func(ctx context.Context) error
+}
+
+// Elector tells whether this instance may fire tasks. Scheduler polls it, runs
+// missed tasks when leadership is gained and cancels running tasks when it is lost.
+type Elector interface {
+	IsLeader() bool
+}
+
+// State stores time of the last run of every task, so missed runs can be
+// detected after restarts and leader changes
+type State interface {
+	LastRun(ctx context.Context, task string) (time.Time, error)
+	SetLastRun(ctx context.Context, task string, t time.Time) error
+}
+
+// Config holds rules that apply to every task
+type Config struct {
+	// Jitter is maximum random delay before a run, so replicas and tasks won't hit
+	// GitHub and database at the same second
+	Jitter time.Duration
+	// CatchUp is CatchUpSkip or CatchUpOnce
+	CatchUp string
+	// MaxConcurrent is how many tasks may run at the same time. Runs over the
+	// limit are skipped.
+	MaxConcurrent int
+}
+
+// Scheduler fires tasks on their schedules. Same task never overlaps with itself.
+type Scheduler struct {
+	config  Config
+	elector Elector
+	state   State
+	tasks   []scheduledTask
+	slots   chan struct{}
+	now     func() time.Time
+	// pollInterval is how often leadership is checked
+	pollInterval time.Duration
+
+	// term is canceled when leadership is lost, nil when not a leader
+	mu   sync.Mutex
+	term context.Context
+}
+
+type scheduledTask struct {
+	Task
+	schedule cron.Schedule
+	// catchUp is signaled when leadership is gained
+	catchUp chan struct{}
+}
+
+// New validates config and returns a scheduler without tasks
+func New(config Config, elector Elector, state State) (*Scheduler, error) {
+	if config.MaxConcurrent < 1 {
+		return nil, fmt.Errorf("max concurrent must be at least 1, got %d", config.MaxConcurrent)
+	}
+	if config.Jitter < 0 {
+		return nil, fmt.Errorf("jitter can't be negative")
+	}
+	config.CatchUp = strings.ToLower(config.CatchUp)
+	if config.CatchUp != CatchUpSkip && config.CatchUp != CatchUpOnce {
+		return nil, fmt.Errorf("unknown catch-up policy '%s'", config.CatchUp)
+	}
+	return &Scheduler{
+		config:  config,
+		elector: elector,
+		state:   state,
+		slots:   make(chan struct{}, config.MaxConcurrent),
+		now:     time.Now,
+
+		pollInterval: time.Second,
+	}, nil
+}
+
+// Add parses schedule of the task and adds it. Tasks with an empty schedule are disabled.
+func (s *Scheduler) Add(task Task) error {
+	if strings.TrimSpace(task.Schedule) == "" {
+		logger.Info("task disabled", "task", task.Name)
+		return nil
+	}
+	schedule, err := parser.Parse(task.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule of task '%s': %v", task.Name, err)
+	}
+	s.tasks = append(s.tasks, scheduledTask{Task: task, schedule: schedule, catchUp: make(chan struct{}, 1)})
+	return nil
+}
+
+// Start runs every task on its schedule until ctx is done. Start returns when
+// running tasks have finished.
+func (s *Scheduler) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.watchLeadership(ctx)
+	}()
+	for _, task := range s.tasks {
+		wg.Add(1)
+		go func(task scheduledTask) {
+			defer wg.Done()
+			s.loop(ctx, task)
+		}(task)
+	}
+	logger.Info("scheduler started", "tasks", len(s.tasks))
+	wg.Wait()
+}
+
+// watchLeadership polls elector until ctx is done. Tasks are run with a context of
+// the leadership term, so a replica that lost the lock stops its running tasks.
+func (s *Scheduler) watchLeadership(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	var cancel context.CancelFunc
+	for {
+		leader := s.elector.IsLeader()
+		switch {
+		case leader && cancel == nil:
+			var term context.Context
+			term, cancel = context.WithCancel(ctx)
+			s.setTerm(term)
+			logger.Info("leadership gained")
+			for _, task := range s.tasks {
+				select {
+				case task.catchUp <- struct{}{}:
+				default:
+				}
+			}
+		case !leader && cancel != nil:
+			logger.Warn("leadership lost, canceling running tasks")
+			s.setTerm(nil)
+			cancel()
+			cancel = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if cancel != nil {
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) setTerm(term context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.term = term
+}
+
+// leaderContext returns context of the current leadership term or nil when not a leader
+func (s *Scheduler) leaderContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.term
+}
+
+// loop waits for the next scheduled time of the task and runs it. Runs are done in
+// the loop's goroutine, so a slow run delays the task instead of overlapping.
+func (s *Scheduler) loop(ctx context.Context, task scheduledTask) {
+	log := logger.With("task", task.Name)
+	for {
+		next := task.schedule.Next(s.now())
+		log.Debug("next run", "at", next.Format(time.RFC3339))
+		timer := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-task.catchUp:
+			timer.Stop()
+			if term := s.leaderContext(); term != nil && s.shouldCatchUp(term, task) {
+				log.Info("running missed task")
+				s.fire(term, task)
+			}
+			continue
+		case <-timer.C:
+		}
+
+		term := s.leaderContext()
+		if term == nil {
+			log.Debug("not a leader, skipping run")
+			continue
+		}
+		s.fire(term, task)
+	}
+}
+
+// shouldCatchUp reports whether scheduled time has passed since the last run
+func (s *Scheduler) shouldCatchUp(ctx context.Context, task scheduledTask) bool {
+	if s.config.CatchUp != CatchUpOnce {
+		return false
+	}
+	last, err := s.state.LastRun(ctx, task.Name)
+	if err != nil {
+		logger.Warn("reading last run failed", "task", task.Name, logger.FieldError, err)
+		return false
+	}
+	// Task has never been run, first run happens on schedule
+	if last.IsZero() {
+		return false
+	}
+	return task.schedule.Next(last).Before(s.now())
+}
+
+// fire waits for jitter and runs the task if there is a free slot
+func (s *Scheduler) fire(ctx context.Context, task scheduledTask) {
+	log := logger.With("task", task.Name)
+	if s.config.Jitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(s.config.Jitter)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		log.Warn("too many tasks running, skipping run", "max_concurrent", s.config.MaxConcurrent)
+		metrics.SchedulerRuns.WithLabelValues(task.Name, "skipped").Inc()
+		return
+	}
+
+	// Time is saved before running, so a crashing task won't be caught up again and again
+	started := s.now()
+	if err := s.state.SetLastRun(ctx, task.Name, started); err != nil {
+		log.Warn("saving last run failed", logger.FieldError, err)
+	}
+
+	ctx, span := tracing.Start(logger.NewContext(ctx, log), "scheduled "+task.Name)
+	defer span.End()
+	log.Info("running task")
+	err := task.Run(ctx)
+	result := "success"
+	if err != nil {
+		result = "failure"
+		tracing.RecordError(span, err)
+		log.Error("task failed", logger.FieldError, err)
+	}
+	metrics.SchedulerRuns.WithLabelValues(task.Name, result).Inc()
+	log.Info("task finished", "result", result, "duration_ms", s.now().Sub(started).Milliseconds())
+}
@@ -0,0 +1,181 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeElector bool
+
+func (f fakeElector) IsLeader() bool { return bool(f) }
+
+// switchElector becomes leader and loses leadership when told
+type switchElector struct {
+	leader int32
+}
+
+func (e *switchElector) IsLeader() bool { return atomic.LoadInt32(&e.leader) == 1 }
+
+func (e *switchElector) set(leader bool) {
+	value := int32(0)
+	if leader {
+		value = 1
+	}
+	atomic.StoreInt32(&e.leader, value)
+}
+
+type memoryState map[string]time.Time
+
+func (m memoryState) LastRun(ctx context.Context, task string) (time.Time, error) {
+	return m[task], nil
+}
+
+func (m memoryState) SetLastRun(ctx context.Context, task string, t time.Time) error {
+	m[task] = t
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	tt := []struct {
+		config Config
+		ok     bool
+	}{
+		{Config{CatchUp: CatchUpSkip, MaxConcurrent: 1}, true},
+		{Config{CatchUp: "ONCE", MaxConcurrent: 2, Jitter: time.Second}, true},
+		{Config{CatchUp: "always", MaxConcurrent: 1}, false},
+		{Config{CatchUp: CatchUpSkip, MaxConcurrent: 0}, false},
+		{Config{CatchUp: CatchUpSkip, MaxConcurrent: 1, Jitter: -time.Second}, false},
+	}
+	for _, item := range tt {
+		_, err := New(item.config, fakeElector(true), memoryState{})
+		if (err == nil) != item.ok {
+			t.Error("unexpected result with", item.config, err)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	s, _ := New(Config{CatchUp: CatchUpSkip, MaxConcurrent: 1}, fakeElector(true), memoryState{})
+	noop := func(ctx context.Context) error { return nil }
+
+	if err := s.Add(Task{Name: "hourly", Schedule: "@hourly", Run: noop}); err != nil {
+		t.Error(err)
+	}
+	if err := s.Add(Task{Name: "disabled", Schedule: "", Run: noop}); err != nil {
+		t.Error(err)
+	}
+	if err := s.Add(Task{Name: "invalid", Schedule: "61 * * * *", Run: noop}); err == nil {
+		t.Error("invalid schedule was accepted")
+	}
+	if len(s.tasks) != 1 {
+		t.Error("expected one task, got", len(s.tasks))
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	now := time.Date(2021, 11, 20, 12, 30, 0, 0, time.UTC)
+	state := memoryState{
+		"missed": now.Add(-time.Hour * 2),
+		"recent": now.Add(-time.Minute * 10),
+	}
+	s, _ := New(Config{CatchUp: CatchUpOnce, MaxConcurrent: 1}, fakeElector(true), state)
+	s.now = func() time.Time { return now }
+
+	tt := []struct {
+		name   string
+		catch  bool
+		policy string
+	}{
+		{"missed", true, CatchUpOnce},
+		{"recent", false, CatchUpOnce},
+		{"never", false, CatchUpOnce},
+		{"missed", false, CatchUpSkip},
+	}
+	for _, item := range tt {
+		s.config.CatchUp = item.policy
+		schedule, _ := parser.Parse("0 * * * *")
+		task := scheduledTask{Task: Task{Name: item.name}, schedule: schedule}
+		if got := s.shouldCatchUp(context.Background(), task); got != item.catch {
+			t.Error(item.name, item.policy, "expected", item.catch, "got", got)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	state := memoryState{}
+	s, _ := New(Config{CatchUp: CatchUpSkip, MaxConcurrent: 1}, fakeElector(true), state)
+
+	ran := false
+	task := scheduledTask{Task: Task{Name: "task", Run: func(ctx context.Context) error {
+		ran = true
+		return nil
+	}}}
+
+	// Take the only slot, so run has to be skipped
+	s.slots <- struct{}{}
+	s.fire(context.Background(), task)
+	if ran {
+		t.Error("task was run over the limit")
+	}
+
+	<-s.slots
+	s.fire(context.Background(), task)
+	if !ran || state["task"].IsZero() {
+		t.Error("task was not run or last run was not saved")
+	}
+}
+
+func TestLeadership(t *testing.T) {
+	// Hourly task was missed, but it is caught up only after leadership is gained
+	state := memoryState{"task": time.Now().Add(-time.Hour * 2)}
+	elector := &switchElector{}
+	s, _ := New(Config{CatchUp: CatchUpOnce, MaxConcurrent: 1}, elector, state)
+	s.pollInterval = time.Millisecond * 10
+
+	started := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	err := s.Add(Task{Name: "task", Schedule: "0 * * * *", Run: func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		canceled <- struct{}{}
+		return ctx.Err()
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Start(ctx)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("task was run without leadership")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	elector.set(true)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("missed task was not run after gaining leadership")
+	}
+
+	elector.set(false)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("task was not canceled after losing leadership")
+	}
+
+	cancel()
+	<-done
+	if time.Since(state["task"]) > time.Minute {
+		t.Error("last run was not saved")
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/lib/repo"
+	"miikka.xyz/devops-app/logger"
+)
+
+// Named badge colors, same as shields.io uses
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+}
+
+var hexColor = regexp.MustCompile(`^[0-9a-fA-F]{3}([0-9a-fA-F]{3})?$`)
+
+const (
+	badgeMaxLabelLength = 48
+	badgeMaxAge         = 300
+)
+
+// badge renders shields style SVG badge with traffic count of a repository.
+// Query parameters: metric=views|uniques|clones, range, label and color.
+func (s *Server) badge(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = "views"
+	}
+	if metric != "views" && metric != "uniques" && metric != "clones" {
+		http.Error(w, "metric must be views, uniques or clones", http.StatusBadRequest)
+		return
+	}
+	trafficRange, err := repo.ParseTrafficRange(query, s.Cache.DefaultWindow, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	color, err := badgeColor(query.Get("color"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	label := query.Get("label")
+	if label == "" {
+		label = fmt.Sprintf("%s %s", metric, trafficRange.Name)
+	}
+	label = truncateLabel(label, badgeMaxLabelLength)
+
+	status := http.StatusOK
+	value := ""
+	if vars["owner"] != consts.GithubOwner {
+		status, value, color = http.StatusNotFound, "not found", badgeColors["lightgrey"]
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+		traffic, err := s.Cache.GetTrafficData(ctx, trafficRange)
+		if err != nil {
+			logger.FromContext(r.Context()).Error("getting traffic data failed", logger.FieldError, err)
+			http.Error(w, consts.ErrDatabase, http.StatusInternalServerError)
+			return
+		}
+		series, found := traffic[vars["repo"]]
+		if !found {
+			// Repository might exist but has no traffic in the range
+			exists, err := repo.StoreGetRepositoryByName(ctx, vars["repo"])
+			if err != nil {
+				logger.FromContext(r.Context()).Error("getting repository failed", logger.FieldError, err)
+				http.Error(w, consts.ErrDatabase, http.StatusInternalServerError)
+				return
+			}
+			if exists == nil {
+				status, value, color = http.StatusNotFound, "not found", badgeColors["lightgrey"]
+			}
+		}
+		if value == "" {
+			value = formatCount(badgeValue(repo.Sum(series), metric))
+		}
+	}
+
+	svg := renderBadge(label, value, color)
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(svg))
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", badgeMaxAge))
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml;charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(svg)
+}
+
+func badgeValue(totals repo.Totals, metric string) int {
+	switch metric {
+	case "uniques":
+		return totals.UniqueViews
+	case "clones":
+		return totals.Clones
+	}
+	return totals.Views
+}
+
+// badgeColor accepts named colors and hex colors without '#'
+func badgeColor(value string) (string, error) {
+	if value == "" {
+		return badgeColors["blue"], nil
+	}
+	if color, found := badgeColors[strings.ToLower(value)]; found {
+		return color, nil
+	}
+	if hexColor.MatchString(value) {
+		return "#" + value, nil
+	}
+	return "", fmt.Errorf("invalid color '%s'", value)
+}
+
+// formatCount formats like 999, 1.2k, 3.4M
+func formatCount(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1_000_000)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1_000)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// textWidth estimates text width in pixels with 11px Verdana
+func textWidth(text string) int {
+	width := 0
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune("il.,:;|!'", r):
+			width += 3
+		case strings.ContainsRune("mwMW", r):
+			width += 10
+		case r >= 'A' && r <= 'Z':
+			width += 8
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+// truncateLabel cuts label to max characters. Cutting bytes could split a
+// multi-byte character and make the SVG invalid.
+func truncateLabel(label string, max int) string {
+	label = strings.ToValidUTF8(label, "")
+	if utf8.RuneCountInString(label) <= max {
+		return label
+	}
+	return string([]rune(label)[:max])
+}
+
+func renderBadge(label string, value string, color string) []byte {
+	const padding = 10
+	labelWidth := textWidth(label) + padding
+	valueWidth := textWidth(value) + padding
+	width := labelWidth + valueWidth
+	label = html.EscapeString(label)
+	value = html.EscapeString(value)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, value)
+	fmt.Fprintf(&buf, `<title>%s: %s</title>`, label, value)
+	buf.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&buf, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, width)
+	buf.WriteString(`<g clip-path="url(#r)">`)
+	fmt.Fprintf(&buf, `<rect width="%d" height="20" fill="#555"/>`, labelWidth)
+	fmt.Fprintf(&buf, `<rect x="%d" width="%d" height="20" fill="%s"/>`, labelWidth, valueWidth, color)
+	fmt.Fprintf(&buf, `<rect width="%d" height="20" fill="url(#s)"/>`, width)
+	buf.WriteString(`</g>`)
+	buf.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	fmt.Fprintf(&buf, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text>`, labelWidth/2, label)
+	fmt.Fprintf(&buf, `<text x="%d" y="14">%s</text>`, labelWidth/2, label)
+	fmt.Fprintf(&buf, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text>`, labelWidth+valueWidth/2, value)
+	fmt.Fprintf(&buf, `<text x="%d" y="14">%s</text>`, labelWidth+valueWidth/2, value)
+	buf.WriteString(`</g></svg>`)
+	return buf.Bytes()
+}
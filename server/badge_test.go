@@ -0,0 +1,27 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateLabel(t *testing.T) {
+	tt := []struct {
+		label string
+		max   int
+		want  string
+	}{
+		{"views 7d", badgeMaxLabelLength, "views 7d"},
+		{"käyttäjät", 4, "käyt"},
+		{"日本語のラベル", 4, "日本語の"},
+		{"ab\xffcdef", 4, "abcd"},
+		{strings.Repeat("ä", badgeMaxLabelLength+10), badgeMaxLabelLength, strings.Repeat("ä", badgeMaxLabelLength)},
+	}
+	for _, item := range tt {
+		got := truncateLabel(item.label, item.max)
+		if got != item.want || !utf8.ValidString(got) {
+			t.Errorf("%q: got %q, want %q", item.label, got, item.want)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/lib/repo"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
+	"miikka.xyz/devops-app/utils"
+)
+
+const (
+	// wsWriteWait is how long a write to a client may take
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may be silent, pongs included
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod has to be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsSendBuffer is how many messages a slow client can fall behind before it's disconnected
+	wsSendBuffer = 16
+	// wsMaxMessage is size limit of client messages
+	wsMaxMessage = 4096
+	// wsMaxRepos is how many repositories a client can subscribe to
+	wsMaxRepos = 100
+	// allRepos subscribes to every repository
+	allRepos = "*"
+)
+
+// Message types
+const (
+	wsTypeSubscribe   = "subscribe"
+	wsTypeUnsubscribe = "unsubscribe"
+	wsTypeSubscribed  = "subscribed"
+	wsTypeSnapshot    = "snapshot"
+	wsTypeTraffic     = "traffic"
+	wsTypeError       = "error"
+)
+
+// Cross-origin connections are refused, dashboards are served from the same host
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// dashboardRequest is a message from client
+type dashboardRequest struct {
+	Type  string   `json:"type"`
+	Repos []string `json:"repos"`
+}
+
+// dashboardMessage is a message to client
+type dashboardMessage struct {
+	Type string `json:"type"`
+	// Window is the traffic range of totals, like 7d
+	Window    string      `json:"window,omitempty"`
+	UpdatedAt *time.Time  `json:"updated_at,omitempty"`
+	Repos     []repoDelta `json:"repos,omitempty"`
+	// Subscribed are repositories the client gets updates of
+	Subscribed []string `json:"subscribed,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// repoDelta is new traffic totals of a repository and change since previous update
+type repoDelta struct {
+	Repo   string      `json:"repo"`
+	Totals repo.Totals `json:"totals"`
+	Delta  repo.Totals `json:"delta"`
+}
+
+// dashboard pushes traffic changes to WebSocket clients of this replica
+type dashboard struct {
+	mu      sync.Mutex
+	clients map[*dashboardClient]struct{}
+	// limiter counts connections, also the ones that are being closed
+	limiter *connLimiter
+	closed  bool
+	// totals are the latest traffic totals by repository
+	totals    map[string]repo.Totals
+	window    string
+	updatedAt time.Time
+}
+
+// dashboardClient is one connection. Send is closed when the client is removed,
+// then closeCode and closeText are sent to client.
+type dashboardClient struct {
+	conn      *websocket.Conn
+	send      chan []byte
+	repos     map[string]bool
+	closeCode int
+	closeText string
+}
+
+func newDashboard() *dashboard {
+	limiter := newConnLimiter(limitFromEnv("WS_MAX_CONNECTIONS", 100), limitFromEnv("WS_MAX_CONNECTIONS_PER_IP", 5))
+	return &dashboard{clients: make(map[*dashboardClient]struct{}), limiter: limiter}
+}
+
+// reserve takes a connection slot of ip. Returns false when a limit is reached.
+func (d *dashboard) reserve(ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || !d.limiter.acquire(ip) {
+		return false
+	}
+	metrics.WebSocketConnections.Inc()
+	return true
+}
+
+// release frees slot taken with reserve
+func (d *dashboard) release(ip string) {
+	d.limiter.release(ip)
+	metrics.WebSocketConnections.Dec()
+}
+
+// add starts sending updates to c and sends it the current totals
+func (d *dashboard) add(c *dashboardClient) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clients[c] = struct{}{}
+	if d.closed {
+		d.removeLocked(c, websocket.CloseGoingAway, "server is shutting down")
+		return
+	}
+	d.queueLocked(c, dashboardMessage{Type: wsTypeSubscribed, Subscribed: c.subscribed()})
+	d.snapshotLocked(c, c.repos)
+}
+
+func (d *dashboard) remove(c *dashboardClient, code int, text string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(c, code, text)
+}
+
+func (d *dashboard) removeLocked(c *dashboardClient, code int, text string) {
+	if _, found := d.clients[c]; !found {
+		return
+	}
+	delete(d.clients, c)
+	c.closeCode, c.closeText = code, text
+	close(c.send)
+}
+
+// queueLocked sends message to c without blocking. Client that has fallen behind is disconnected.
+func (d *dashboard) queueLocked(c *dashboardClient, msg dashboardMessage) {
+	// Removed client may still send requests before its connection closes
+	if _, found := d.clients[c]; !found {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logger.Error("encoding dashboard message failed", logger.FieldError, err)
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		metrics.WebSocketDropped.WithLabelValues("slow").Inc()
+		d.removeLocked(c, websocket.CloseTryAgainLater, "client is too slow")
+	}
+}
+
+// snapshotLocked sends current totals of repos to c
+func (d *dashboard) snapshotLocked(c *dashboardClient, repos map[string]bool) {
+	if d.totals == nil {
+		return
+	}
+	deltas := make([]repoDelta, 0)
+	for name, totals := range d.totals {
+		if repos[allRepos] || repos[name] {
+			deltas = append(deltas, repoDelta{Repo: name, Totals: totals})
+		}
+	}
+	sortDeltas(deltas)
+	updatedAt := d.updatedAt
+	d.queueLocked(c, dashboardMessage{Type: wsTypeSnapshot, Window: d.window, UpdatedAt: &updatedAt, Repos: deltas})
+}
+
+// request changes subscriptions of c
+func (d *dashboard) request(c *dashboardClient, req dashboardRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch req.Type {
+	case wsTypeSubscribe:
+		added := make(map[string]bool)
+		for _, name := range req.Repos {
+			if !c.repos[name] {
+				added[name] = true
+				c.repos[name] = true
+			}
+		}
+		if len(c.repos) > wsMaxRepos {
+			for name := range added {
+				delete(c.repos, name)
+			}
+			d.queueLocked(c, dashboardMessage{Type: wsTypeError, Error: "too many subscriptions, max " + strconv.Itoa(wsMaxRepos)})
+			return
+		}
+		d.queueLocked(c, dashboardMessage{Type: wsTypeSubscribed, Subscribed: c.subscribed()})
+		d.snapshotLocked(c, added)
+	case wsTypeUnsubscribe:
+		for _, name := range req.Repos {
+			delete(c.repos, name)
+		}
+		d.queueLocked(c, dashboardMessage{Type: wsTypeSubscribed, Subscribed: c.subscribed()})
+	default:
+		d.queueLocked(c, dashboardMessage{Type: wsTypeError, Error: "unknown type, expected subscribe or unsubscribe"})
+	}
+}
+
+// update saves new totals and sends changed repositories to clients subscribed to them
+func (d *dashboard) update(window string, totals map[string]repo.Totals, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	previous := d.totals
+	d.totals, d.window, d.updatedAt = totals, window, at
+	// First totals are only a starting point for deltas
+	if previous == nil {
+		return
+	}
+
+	changed := make([]repoDelta, 0)
+	for name, t := range totals {
+		if before, found := previous[name]; !found || before != t {
+			changed = append(changed, repoDelta{Repo: name, Totals: t, Delta: subtract(t, before)})
+		}
+	}
+	// Removed repositories drop to zero
+	for name, before := range previous {
+		if _, found := totals[name]; !found {
+			changed = append(changed, repoDelta{Repo: name, Delta: subtract(repo.Totals{}, before)})
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sortDeltas(changed)
+
+	for c := range d.clients {
+		deltas := make([]repoDelta, 0)
+		for _, delta := range changed {
+			if c.repos[allRepos] || c.repos[delta.Repo] {
+				deltas = append(deltas, delta)
+			}
+		}
+		if len(deltas) > 0 {
+			d.queueLocked(c, dashboardMessage{Type: wsTypeTraffic, Window: window, UpdatedAt: &at, Repos: deltas})
+		}
+	}
+}
+
+// close disconnects every client so shutdown doesn't leave connections open
+func (d *dashboard) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for c := range d.clients {
+		d.removeLocked(c, websocket.CloseGoingAway, "server is shutting down")
+	}
+}
+
+// subscribed returns sorted names of subscribed repositories
+func (c *dashboardClient) subscribed() []string {
+	names := make([]string, 0, len(c.repos))
+	for name := range c.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writePump writes queued messages and pings. Connection is closed when it returns.
+func (c *dashboardClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	defer c.conn.Close()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeText))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump reads subscription requests until the connection fails or client goes silent
+func (c *dashboardClient) readPump(d *dashboard) {
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		// Any message proves the client is alive
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		req := dashboardRequest{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			d.mu.Lock()
+			d.queueLocked(c, dashboardMessage{Type: wsTypeError, Error: consts.ErrJSON})
+			d.mu.Unlock()
+			continue
+		}
+		d.request(c, req)
+	}
+}
+
+// handleDashboardSocket godoc
+// @Summary Live traffic over WebSocket
+// @Description Pushes per repository traffic totals of the default window and their change whenever the cache is rebuilt. Send {"type": "subscribe", "repos": ["name"]} or unsubscribe to choose repositories, "*" is all.
+// @Tags repos
+// @Param repos query string false "Comma separated repositories to subscribe to, default is all"
+// @Success 101
+// @Failure 503 {object} utils.ErrorResponse
+// @Router /api/v1/ws/traffic [get]
+func (s *Server) handleDashboardSocket(w http.ResponseWriter, r *http.Request) {
+	ip := utils.ClientIP(r)
+	if !s.dashboard.reserve(ip) {
+		metrics.WebSocketDropped.WithLabelValues("limit").Inc()
+		utils.WriteJSONError(w, http.StatusServiceUnavailable, "too many connections")
+		return
+	}
+	defer s.dashboard.release(ip)
+
+	repos := map[string]bool{allRepos: true}
+	if value := r.URL.Query().Get("repos"); value != "" {
+		repos = make(map[string]bool)
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				repos[name] = true
+			}
+		}
+		if len(repos) > wsMaxRepos {
+			utils.WriteJSONError(w, http.StatusBadRequest, "too many repositories, max "+strconv.Itoa(wsMaxRepos))
+			return
+		}
+	}
+
+	// Upgrade writes error response itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.FromContext(r.Context()).Warn("websocket upgrade failed", logger.FieldError, err)
+		return
+	}
+	c := &dashboardClient{conn: conn, send: make(chan []byte, wsSendBuffer), repos: repos}
+	s.dashboard.add(c)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.writePump()
+	}()
+	c.readPump(s.dashboard)
+	s.dashboard.remove(c, websocket.CloseNormalClosure, "")
+	<-done
+}
+
+// WatchTraffic sends traffic changes to dashboard clients after every cache
+// rebuild until ctx is done
+func (s *Server) WatchTraffic(ctx context.Context) {
+	updates := s.Cache.TrafficUpdates(ctx)
+	s.refreshDashboard(ctx)
+	for range updates {
+		s.refreshDashboard(ctx)
+	}
+}
+
+// refreshDashboard reads totals of the default window from cache
+func (s *Server) refreshDashboard(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	now := time.Now()
+	trafficRange, err := repo.NamedRange(s.Cache.DefaultWindow, now)
+	if err != nil {
+		logger.Error("invalid default window", logger.FieldError, err)
+		return
+	}
+	traffic, err := s.Cache.GetTrafficData(ctx, trafficRange)
+	if err != nil {
+		logger.Warn("getting traffic for dashboard failed", logger.FieldError, err)
+		return
+	}
+	totals := make(map[string]repo.Totals, len(traffic))
+	for name, list := range traffic {
+		totals[name] = repo.Sum(list)
+	}
+	s.dashboard.update(trafficRange.Name, totals, now.UTC())
+}
+
+func subtract(a, b repo.Totals) repo.Totals {
+	return repo.Totals{
+		Views:        a.Views - b.Views,
+		UniqueViews:  a.UniqueViews - b.UniqueViews,
+		Clones:       a.Clones - b.Clones,
+		UniqueClones: a.UniqueClones - b.UniqueClones,
+	}
+}
+
+func sortDeltas(deltas []repoDelta) {
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Repo < deltas[j].Repo })
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"miikka.xyz/devops-app/lib/repo"
+)
+
+func TestDashboardSocket(t *testing.T) {
+	s := &Server{dashboard: &dashboard{clients: make(map[*dashboardClient]struct{}), limiter: newConnLimiter(10, 1)}}
+	s.dashboard.update("7d", map[string]repo.Totals{"a": {Views: 1}, "b": {Views: 2}}, time.Now())
+	server := httptest.NewServer(http.HandlerFunc(s.handleDashboardSocket))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?repos=a"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() dashboardMessage {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		msg := dashboardMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := read(); msg.Type != wsTypeSubscribed || len(msg.Subscribed) != 1 {
+		t.Error("expected subscription to a", msg)
+	}
+	if msg := read(); msg.Type != wsTypeSnapshot || len(msg.Repos) != 1 || msg.Repos[0].Totals.Views != 1 {
+		t.Error("expected snapshot of a", msg)
+	}
+
+	// Only one connection of an IP is allowed
+	if _, res, err := websocket.DefaultDialer.Dial(url, nil); err == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("second connection should be refused", err)
+	}
+
+	// Unchanged and unsubscribed repositories are not sent
+	s.dashboard.update("7d", map[string]repo.Totals{"a": {Views: 5}, "b": {Views: 3}, "c": {}}, time.Now())
+	msg := read()
+	if msg.Type != wsTypeTraffic || len(msg.Repos) != 1 || msg.Repos[0].Delta.Views != 4 || msg.Repos[0].Totals.Views != 5 {
+		t.Error("wrong traffic update", msg)
+	}
+
+	if err := conn.WriteJSON(dashboardRequest{Type: wsTypeSubscribe, Repos: []string{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := read(); msg.Type != wsTypeSubscribed || len(msg.Subscribed) != 2 {
+		t.Error("expected subscription to a and b", msg)
+	}
+	if msg := read(); msg.Type != wsTypeSnapshot || len(msg.Repos) != 1 || msg.Repos[0].Repo != "b" {
+		t.Error("expected snapshot of b", msg)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if msg := read(); msg.Type != wsTypeError {
+		t.Error("expected error of invalid message", msg)
+	}
+
+	// Shutdown closes connections
+	s.dashboard.close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Error("expected going away, got", err)
+	}
+}
+
+func TestDashboardSlowClient(t *testing.T) {
+	d := &dashboard{clients: make(map[*dashboardClient]struct{}), limiter: newConnLimiter(10, 10)}
+	d.update("7d", map[string]repo.Totals{}, time.Now())
+	c := &dashboardClient{send: make(chan []byte, wsSendBuffer), repos: map[string]bool{allRepos: true}}
+	d.add(c)
+	// Client doesn't read, so buffer fills up
+	for i := 1; i <= wsSendBuffer+1; i++ {
+		d.update("7d", map[string]repo.Totals{"a": {Views: i}}, time.Now())
+	}
+	if _, found := d.clients[c]; found {
+		t.Fatal("slow client should be removed")
+	}
+	if c.closeCode != websocket.CloseTryAgainLater {
+		t.Error("wrong close code", c.closeCode)
+	}
+	// Requests of removed client are ignored
+	d.request(c, dashboardRequest{Type: wsTypeSubscribe, Repos: []string{"b"}})
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// connLimiter limits long-lived connections in total and per client IP, so one
+// client can't take every connection
+type connLimiter struct {
+	mu       sync.Mutex
+	max      int
+	maxPerIP int
+	active   int
+	byIP     map[string]int
+}
+
+func newConnLimiter(max, maxPerIP int) *connLimiter {
+	return &connLimiter{max: max, maxPerIP: maxPerIP, byIP: make(map[string]int)}
+}
+
+// acquire takes a connection slot of ip. Returns false when either limit is reached.
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active >= l.max || l.byIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.active++
+	l.byIP[ip]++
+	return true
+}
+
+// release frees slot taken with acquire
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// limitFromEnv returns positive integer from env or def when it's not set or invalid
+func limitFromEnv(key string, def int) int {
+	value, err := strconv.Atoi(utils.GetEnv(key, strconv.Itoa(def)))
+	if err != nil || value < 1 {
+		logger.Warn("invalid "+key+", using default", "value", utils.GetEnv(key, ""))
+		return def
+	}
+	return value
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(3, 2)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatal("first connections should be allowed")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Error("third connection of one IP should be refused")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Error("other IP should be allowed")
+	}
+	if l.acquire("10.0.0.3") {
+		t.Error("connections over the total limit should be refused")
+	}
+
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.3") {
+		t.Error("released slot should be free")
+	}
+	l.release("10.0.0.2")
+	if _, found := l.byIP["10.0.0.2"]; found {
+		t.Error("IP without connections should be removed")
+	}
+}
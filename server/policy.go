@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/token"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// permission is what a route requires
+type permission string
+
+// Permissions
+const (
+	permTrafficRead permission = "traffic:read"
+	permUsersRead   permission = "users:read"
+	permUsersManage permission = "users:manage"
+	permReposTag    permission = "repos:tag"
+	permJobsRead    permission = "jobs:read"
+	permJobsTrigger permission = "jobs:trigger"
+	permCacheManage permission = "cache:manage"
+	permAuditRead   permission = "audit:read"
+	// permNotificationsRead is reading and acknowledging own notifications
+	permNotificationsRead permission = "notifications:read"
+	// permWebhooksManage is managing webhooks and replaying their deliveries
+	permWebhooksManage permission = "webhooks:manage"
+	// permTokensManage is managing own API tokens. No scope grants it, so tokens
+	// can't be managed with a token.
+	permTokensManage permission = "tokens:manage"
+)
+
+// anonymousPermissions are granted to requests without a user
+var anonymousPermissions = []permission{permTrafficRead}
+
+// ownPermissions act on resources of the user, so ADMIN_TOKEN without a user
+// doesn't have them
+var ownPermissions = []permission{permNotificationsRead, permTokensManage}
+
+// rolePermissions are granted to users by role. Every role has permissions of
+// the roles below it.
+var rolePermissions = map[string][]permission{
+	user.RoleViewer:     {permTrafficRead, permUsersRead, permNotificationsRead, permTokensManage},
+	user.RoleMaintainer: {permTrafficRead, permUsersRead, permNotificationsRead, permTokensManage, permReposTag, permJobsRead, permJobsTrigger, permCacheManage},
+	user.RoleAdmin:      {permTrafficRead, permUsersRead, permNotificationsRead, permTokensManage, permReposTag, permJobsRead, permJobsTrigger, permCacheManage, permUsersManage, permAuditRead, permWebhooksManage},
+}
+
+// scopePermissions are granted to API tokens by scope. A token never gets more
+// than the role of its user.
+var scopePermissions = map[string][]permission{
+	token.ScopeReadTraffic: {permTrafficRead},
+	token.ScopeAdminJobs:   {permJobsRead, permJobsTrigger},
+}
+
+// allows tells if user with role, and with scopes when the request was made with a
+// token, has perm. Empty role is anonymous.
+func allows(role string, scopes []string, perm permission) bool {
+	granted := anonymousPermissions
+	if role != "" {
+		granted = rolePermissions[role]
+	}
+	if !hasPermission(granted, perm) {
+		return false
+	}
+	if scopes == nil {
+		return true
+	}
+	for _, scope := range scopes {
+		if hasPermission(scopePermissions[scope], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPermission(granted []permission, perm permission) bool {
+	for _, p := range granted {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// require lets request through to next only if it has perm. 'Authorization:
+// Bearer <ADMIN_TOKEN>' has every permission but own ones, ADMIN_TOKEN is disabled
+// when it's not set. Denied requests get 401 without a user and 403 with one.
+// Denials of users are recorded to the audit log. Anonymous ones are only logged,
+// so unauthenticated clients can't fill the audit log.
+func (s *Server) require(perm permission, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasPermission(ownPermissions, perm) && s.isAdminToken(r) {
+			next.ServeHTTP(w, r.WithContext(audit.WithActor(r.Context(), audit.ActorAdminToken)))
+			return
+		}
+
+		role := ""
+		var scopes []string
+		u := auth.UserFromContext(r.Context())
+		if u != nil {
+			role = u.Role
+			if role == "" {
+				role = user.RoleViewer
+			}
+		}
+		t := token.FromContext(r.Context())
+		if t != nil {
+			scopes = t.Scopes
+		}
+		if allows(role, scopes, perm) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger.FromContext(r.Context()).Warn("access denied", "path", r.URL.Path, "permission", perm)
+		if u != nil {
+			audit.Record(r, audit.ActionAccessDenied, primitive.NilObjectID, map[string]interface{}{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"permission": string(perm),
+			})
+		}
+		status, message := http.StatusForbidden, "missing permission"
+		switch {
+		case u == nil:
+			status, message = http.StatusUnauthorized, "authentication required"
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		case t != nil && hasPermission(rolePermissions[role], perm):
+			message = "token is missing scope for permission"
+		}
+		utils.WriteJSON(w, status, accessDenied{Error: message, Permission: string(perm)})
+	})
+}
+
+// accessDenied is the body of 401 and 403 responses of require
+type accessDenied struct {
+	Error      string `json:"error"`
+	Permission string `json:"permission"`
+}
+
+func (s *Server) isAdminToken(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	value := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(value), []byte(s.adminToken)) == 1
+}
+
+// auditActor makes the user of the request the actor of its audit log entries
+func auditActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := auth.UserFromContext(r.Context()); u != nil {
+			r = r.WithContext(audit.WithUser(r.Context(), u.ID, u.Username))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
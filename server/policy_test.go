@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"miikka.xyz/devops-app/lib/token"
+	"miikka.xyz/devops-app/lib/user"
+)
+
+func TestAllows(t *testing.T) {
+	tt := []struct {
+		role    string
+		scopes  []string
+		perm    permission
+		allowed bool
+	}{
+		{"", nil, permTrafficRead, true},
+		{"", nil, permUsersRead, false},
+		{user.RoleViewer, nil, permUsersRead, true},
+		{user.RoleViewer, nil, permJobsTrigger, false},
+		{user.RoleViewer, nil, permNotificationsRead, true},
+		{"", nil, permNotificationsRead, false},
+		{user.RoleMaintainer, nil, permJobsTrigger, true},
+		{user.RoleMaintainer, nil, permReposTag, true},
+		{user.RoleMaintainer, nil, permUsersManage, false},
+		{user.RoleAdmin, nil, permUsersManage, true},
+		{user.RoleMaintainer, nil, permAuditRead, false},
+		{user.RoleAdmin, nil, permAuditRead, true},
+		{user.RoleMaintainer, nil, permWebhooksManage, false},
+		{user.RoleAdmin, nil, permWebhooksManage, true},
+		{"unknown", nil, permTrafficRead, false},
+		// Tokens are limited by both scopes and role
+		{user.RoleAdmin, []string{token.ScopeReadTraffic}, permTrafficRead, true},
+		{user.RoleAdmin, []string{token.ScopeReadTraffic}, permJobsRead, false},
+		{user.RoleAdmin, []string{token.ScopeAdminJobs}, permJobsTrigger, true},
+		{user.RoleAdmin, []string{token.ScopeAdminJobs}, permUsersManage, false},
+		{user.RoleAdmin, []string{token.ScopeAdminJobs}, permCacheManage, false},
+		{user.RoleAdmin, []string{token.ScopeAdminJobs}, permAuditRead, false},
+		{user.RoleViewer, []string{token.ScopeAdminJobs}, permJobsTrigger, false},
+		{user.RoleViewer, []string{}, permTrafficRead, false},
+		{user.RoleViewer, []string{token.ScopeReadTraffic}, permNotificationsRead, false},
+		{"", nil, permTokensManage, false},
+		{user.RoleViewer, nil, permTokensManage, true},
+		{user.RoleAdmin, []string{token.ScopeReadTraffic, token.ScopeAdminJobs}, permTokensManage, false},
+	}
+	for i, item := range tt {
+		if allows(item.role, item.scopes, item.perm) != item.allowed {
+			t.Error(i, item.role, item.scopes, item.perm, "expected", item.allowed)
+		}
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	s := &Server{adminToken: "secret"}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	tt := []struct {
+		perm   permission
+		header string
+		status int
+	}{
+		{permJobsTrigger, "Bearer secret", http.StatusOK},
+		{permJobsTrigger, "Bearer wrong", http.StatusUnauthorized},
+		{permJobsTrigger, "", http.StatusUnauthorized},
+		// Own permissions need a user
+		{permTokensManage, "Bearer secret", http.StatusUnauthorized},
+		{permNotificationsRead, "Bearer secret", http.StatusUnauthorized},
+	}
+	for _, item := range tt {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/tokens", nil)
+		if item.header != "" {
+			req.Header.Set("Authorization", item.header)
+		}
+		recorder := httptest.NewRecorder()
+		s.require(item.perm, ok).ServeHTTP(recorder, req)
+		if recorder.Code != item.status {
+			t.Error(item.perm, item.header, "expected", item.status, "got", recorder.Code)
+		}
+	}
+}
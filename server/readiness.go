@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// ReadinessCheck returns an error when a dependency is not ready
+type ReadinessCheck func(ctx context.Context) error
+
+type readiness struct {
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]ReadinessCheck
+}
+
+// AddReadinessCheck registers check which has to pass before '/_ready' reports ready
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.readiness.mu.Lock()
+	defer s.readiness.mu.Unlock()
+	if s.readiness.checks == nil {
+		s.readiness.checks = make(map[string]ReadinessCheck)
+	}
+	if _, found := s.readiness.checks[name]; !found {
+		s.readiness.names = append(s.readiness.names, name)
+	}
+	s.readiness.checks[name] = check
+}
+
+// readyCheck runs all readiness checks. Unlike '/_health' this fails until
+// databases, queue and cache are usable.
+func (s *Server) readyCheck(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		utils.WriteJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"ready":  false,
+			"checks": map[string]string{"server": "shutting down"},
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	defer cancel()
+
+	s.readiness.mu.RLock()
+	defer s.readiness.mu.RUnlock()
+
+	ready := true
+	results := make(map[string]string, len(s.readiness.names))
+	for _, name := range s.readiness.names {
+		if err := s.readiness.checks[name](ctx); err != nil {
+			ready = false
+			results[name] = err.Error()
+			continue
+		}
+		results[name] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		logger.Warn("not ready", "checks", results)
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":  ready,
+		"checks": results,
+	})
+}
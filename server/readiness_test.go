@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	router := mux.NewRouter()
+	s := &Server{HTTP: &http.Server{Handler: router}, dashboard: newDashboard(), drainDelay: time.Millisecond * 300}
+	router.HandleFunc("/_ready", s.readyCheck)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.HTTP.Serve(listener)
+	url := "http://" + listener.Addr().String() + "/_ready"
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// Not ready, but still serving while load balancer catches up
+	time.Sleep(time.Millisecond * 50)
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal("server should serve during drain delay", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("expected 503, got", res.StatusCode)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < s.drainDelay {
+		t.Error("shutdown returned before drain delay")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("listener should be closed after shutdown")
+	}
+}
@@ -5,17 +5,27 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	"miikka.xyz/devops-app/cache"
 	"miikka.xyz/devops-app/consts"
 	_ "miikka.xyz/devops-app/docs"
+	"miikka.xyz/devops-app/lib/audit"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/feed"
+	"miikka.xyz/devops-app/lib/job"
 	"miikka.xyz/devops-app/lib/notification"
 	"miikka.xyz/devops-app/lib/repo"
+	"miikka.xyz/devops-app/lib/token"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/lib/webhook"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/metrics"
 	"miikka.xyz/devops-app/utils"
 )
 
@@ -26,14 +36,39 @@ type Server struct {
 	HTTP         *http.Server
 	EventChannel *amqp.Channel
 	Cache        *cache.Cache
+	readiness    readiness
+	// shuttingDown is set when shutdown starts
+	shuttingDown int32
+	// drainDelay is how long server keeps serving after it stopped being ready,
+	// so readiness probe can remove it from endpoints first
+	drainDelay time.Duration
+	// adminToken has every permission, it is disabled when empty
+	adminToken string
+	// auth holds user sessions
+	auth *auth.Config
+	// broker passes stored events to event streams
+	broker broker
+	// streams limits event stream connections
+	streams *connLimiter
+	// dashboard pushes traffic changes to WebSocket clients
+	dashboard *dashboard
+	// exportTimeout is write deadline of exports, those take longer than WriteTimeout
+	exportTimeout time.Duration
 }
 
 func New(port string, ch *amqp.Channel, cacheClient *cache.Cache) *Server {
 	server := &Server{
-		EventChannel: ch,
-		Cache:        cacheClient,
+		EventChannel:  ch,
+		Cache:         cacheClient,
+		adminToken:    utils.GetEnv("ADMIN_TOKEN", ""),
+		auth:          auth.ConfigFromEnv(cacheClient.UniversalClient),
+		dashboard:     newDashboard(),
+		streams:       newConnLimiter(limitFromEnv("SSE_MAX_CONNECTIONS", 1000), limitFromEnv("SSE_MAX_CONNECTIONS_PER_IP", 10)),
+		exportTimeout: utils.GetEnvDuration("EXPORT_TIMEOUT", time.Minute*10),
+		drainDelay:    utils.GetEnvDuration("SHUTDOWN_DRAIN_DELAY", time.Second*10),
 		HTTP: &http.Server{
 			Handler:           mux.NewRouter(),
+			ConnContext:       saveConn,
 			Addr:              "0.0.0.0:" + port,
 			WriteTimeout:      30 * time.Second,
 			ReadTimeout:       30 * time.Second,
@@ -45,6 +80,21 @@ func New(port string, ch *amqp.Channel, cacheClient *cache.Cache) *Server {
 	return server
 }
 
+// Shutdown marks server not ready so it gets removed from load balancing, keeps
+// serving for drain delay and then waits for in-flight requests to finish until
+// ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	// Closing listener right away would refuse requests that are still routed here
+	select {
+	case <-time.After(s.drainDelay):
+	case <-ctx.Done():
+	}
+	s.broker.close()
+	s.dashboard.close()
+	return s.HTTP.Shutdown(ctx)
+}
+
 // @title miikka.xyz API with Swagger
 // @version 1.0
 // @description Demo
@@ -60,19 +110,85 @@ func New(port string, ch *amqp.Channel, cacheClient *cache.Cache) *Server {
 // @BasePath /
 // @query.collection.format multi
 
+// @securityDefinitions.apikey AdminToken
+// @in header
+// @name Authorization
+
 // @x-extension-openapi {"example": "value on a json format"}
 func (s *Server) initRoutes() {
 	router, ok := s.HTTP.Handler.(*mux.Router)
 	if !ok {
-		log.Fatal("Error with router")
+		logger.Fatal("error with router")
 	}
 
 	// Uncomment to enable Swagger
 	// router.PathPrefix("/swagger").Handler(httpSwagger.WrapHandler)
 
+	// Tracing middleware is first so other middlewares see the span
+	router.Use(otelmux.Middleware(consts.ServiceAPI))
+	router.Use(logger.Middleware)
+	router.Use(metrics.Middleware)
+	router.Use(s.auth.Middleware)
+	router.Use(s.authenticateToken)
+	router.Use(auditActor)
+
 	router.HandleFunc("/_health", healthCheck).Methods("GET")
-	router.HandleFunc("/notification", notification.HandleGetNotifications(s.EventChannel)).Methods("GET")
+	router.HandleFunc("/_ready", s.readyCheck).Methods("GET")
+	router.HandleFunc("/badge/{owner}/{repo}.svg", s.badge).Methods("GET")
+	router.HandleFunc("/feed.atom", feed.HandleAtom).Methods("GET")
+	router.HandleFunc("/feed.rss", feed.HandleRSS).Methods("GET")
 	router.HandleFunc("/", s.home).Methods("GET")
+
+	// JSON API, every route declares the permission it requires
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Handle("/repos", s.require(permTrafficRead, repo.HandleListRepos(s.Cache, s.Cache.DefaultWindow))).Methods("GET")
+	api.Handle("/repos/{name}/traffic", s.require(permTrafficRead, repo.HandleGetRepoTraffic(s.Cache, s.Cache.DefaultWindow))).Methods("GET")
+	api.Handle("/traffic/totals", s.require(permTrafficRead, repo.HandleGetTrafficTotals(s.Cache, s.Cache.DefaultWindow))).Methods("GET")
+	api.Handle("/export/traffic.{format:csv|ndjson}", withWriteTimeout(s.exportTimeout, s.require(permTrafficRead, repo.HandleExportTraffic(s.Cache.DefaultWindow)))).Methods("GET")
+
+	// Sessions
+	api.HandleFunc("/auth/register", s.auth.HandleRegister(s.EventChannel)).Methods("POST")
+	api.HandleFunc("/auth/login", s.auth.HandleLogin).Methods("POST")
+	api.HandleFunc("/auth/logout", s.auth.HandleLogout).Methods("POST")
+	api.Handle("/auth/me", auth.RequireUser(http.HandlerFunc(auth.HandleMe))).Methods("GET")
+
+	// Personal API tokens
+	api.Handle("/tokens", s.require(permTokensManage, token.HandleCreateToken)).Methods("POST")
+	api.Handle("/tokens", s.require(permTokensManage, token.HandleListTokens)).Methods("GET")
+	api.Handle("/tokens/{id}", s.require(permTokensManage, token.HandleRevokeToken)).Methods("DELETE")
+
+	// Live events, anonymous clients get traffic events
+	api.Handle("/events/stream", s.require(permTrafficRead, s.handleEventStream)).Methods("GET")
+
+	api.Handle("/ws/traffic", s.require(permTrafficRead, s.handleDashboardSocket)).Methods("GET")
+
+	// Notifications are events of the logged in user
+	api.Handle("/notifications", s.require(permNotificationsRead, notification.HandleGetNotifications)).Methods("GET")
+	api.Handle("/notifications/count", s.require(permNotificationsRead, notification.HandleCountUnread)).Methods("GET")
+	api.Handle("/notifications/ack", s.require(permNotificationsRead, notification.HandleAckAll)).Methods("POST")
+	api.Handle("/notifications/{id}/ack", s.require(permNotificationsRead, notification.HandleAck)).Methods("POST")
+
+	// Users
+	api.Handle("/users", s.require(permUsersRead, user.HandleListUsers)).Methods("GET")
+	api.Handle("/users/{username}", s.require(permUsersRead, user.HandleGetUserByUsername)).Methods("GET")
+	api.Handle("/users", s.require(permUsersManage, user.HandleCreateUser(s.EventChannel))).Methods("POST")
+	api.Handle("/users/{username}", s.require(permUsersManage, user.HandleUpdateUser)).Methods("PATCH")
+	api.Handle("/users/{username}", s.require(permUsersManage, user.HandleDeleteUser)).Methods("DELETE")
+
+	// Jobs and cache
+	api.Handle("/admin/jobs/traffic/runs", s.require(permJobsTrigger, job.HandleTriggerTrafficJob(s.EventChannel))).Methods("POST")
+	api.Handle("/admin/jobs/runs", s.require(permJobsRead, job.HandleListRuns)).Methods("GET")
+	api.Handle("/admin/jobs/runs/{run_id}", s.require(permJobsRead, job.HandleGetRun)).Methods("GET")
+	api.Handle("/admin/cache/refresh", s.require(permCacheManage, job.HandleRefreshCache(s.Cache, s.Cache.Windows))).Methods("POST")
+	api.Handle("/admin/audit", s.require(permAuditRead, audit.HandleListEntries)).Methods("GET")
+
+	// Webhooks, deliveries are sent by events consumer
+	api.Handle("/admin/webhooks", s.require(permWebhooksManage, webhook.HandleCreateWebhook)).Methods("POST")
+	api.Handle("/admin/webhooks", s.require(permWebhooksManage, webhook.HandleListWebhooks)).Methods("GET")
+	api.Handle("/admin/webhooks/{id}", s.require(permWebhooksManage, webhook.HandleDeleteWebhook)).Methods("DELETE")
+	api.Handle("/admin/webhooks/{id}/deliveries", s.require(permWebhooksManage, webhook.HandleListDeliveries)).Methods("GET")
+	api.Handle("/admin/webhooks/{id}/replay", s.require(permWebhooksManage, webhook.HandleReplayWebhook(s.EventChannel))).Methods("POST")
+	api.Handle("/admin/webhooks/{id}/deliveries/{delivery_id}/replay", s.require(permWebhooksManage, webhook.HandleReplayDelivery(s.EventChannel))).Methods("POST")
 }
 
 // home renders template with traffic statistics
@@ -80,25 +196,36 @@ func (s *Server) home(w http.ResponseWriter, r *http.Request) {
 	templateFuncs := map[string]interface{}{
 		"GetLink":        repo.TemplateGetLink,
 		"DateToEuropean": utils.DateToEuropean,
+		"Sparkline":      repo.TemplateSparkline,
+		"BarChart":       repo.TemplateBarChart,
+		"Totals":         repo.TemplateTotals,
 	}
 	tpl, err := template.New("home").Funcs(templateFuncs).ParseFS(embedFS, "tmpls/index.go.html")
 	if err != nil {
-		log.Println("error while creating template", err)
+		logger.FromContext(r.Context()).Error("creating template failed", logger.FieldError, err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
+	trafficRange, err := repo.ParseTrafficRange(r.URL.Query(), s.Cache.DefaultWindow, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	templateData := map[string]interface{}{
 		"version":   consts.Version,
 		"buildTime": consts.Build,
+		"range":     trafficRange,
+		"windows":   s.Cache.Windows,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	reposByName, err := s.Cache.GetTrafficData(ctx)
+	reposByName, err := s.Cache.GetTrafficData(ctx, trafficRange)
 
 	if err != nil {
-		log.Println("could not find data from cache")
+		logger.FromContext(r.Context()).Warn("could not get traffic data", logger.FieldError, err)
 		templateData["repos"] = make(repo.ReposByNameMap)
 	} else {
 		templateData["repos"] = reposByName
@@ -106,12 +233,12 @@ func (s *Server) home(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/html")
 	if err := tpl.ExecuteTemplate(w, "home", templateData); err != nil {
-		log.Println(err)
+		logger.FromContext(r.Context()).Error("executing template failed", logger.FieldError, err)
 		return
 	}
 }
 
 func healthCheck(w http.ResponseWriter, r *http.Request) {
-	log.Println("health check")
+	logger.Debug("health check")
 	fmt.Fprintf(w, "OK")
 }
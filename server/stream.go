@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/notification"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+const (
+	// streamBuffer is how many events a slow client can fall behind before its
+	// stream is closed. Client resumes from database when it reconnects.
+	streamBuffer = 32
+	// streamReplayLimit is how many missed events are sent on resume at once
+	streamReplayLimit = 100
+	// streamHeartbeat keeps proxies from closing idle streams
+	streamHeartbeat = 10 * time.Second
+	// streamRetry is how soon browsers reconnect, in milliseconds
+	streamRetry = 1000
+)
+
+// broker passes stored events from RabbitMQ to event streams of this replica
+type broker struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	closed  bool
+}
+
+// streamClient gets events relevant to its user. Events is closed when the
+// client falls behind or the server shuts down.
+type streamClient struct {
+	user   *user.User
+	events chan events.Event
+}
+
+func (b *broker) subscribe(u *user.User) *streamClient {
+	c := &streamClient{user: u, events: make(chan events.Event, streamBuffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(c.events)
+		return c
+	}
+	if b.clients == nil {
+		b.clients = make(map[*streamClient]struct{})
+	}
+	b.clients[c] = struct{}{}
+	return c
+}
+
+func (b *broker) unsubscribe(c *streamClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, found := b.clients[c]; found {
+		delete(b.clients, c)
+		close(c.events)
+	}
+}
+
+// publish sends event to clients it's relevant to. It never blocks, clients
+// that are full are dropped.
+func (b *broker) publish(event events.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if !notification.Relevant(c.user, event) {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			delete(b.clients, c)
+			close(c.events)
+		}
+	}
+}
+
+// close ends every stream so shutdown doesn't wait for them
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for c := range b.clients {
+		delete(b.clients, c)
+		close(c.events)
+	}
+}
+
+// ConsumeStoredEvents feeds event streams from an exclusive queue of stored
+// events, see events.SubscribeStored. Returns when msgs is closed.
+func (s *Server) ConsumeStoredEvents(msgs <-chan amqp.Delivery) {
+	for msg := range msgs {
+		event := events.Event{}
+		if err := json.Unmarshal(msg.Body, &event); err != nil {
+			logger.Error("invalid stored event", "body", string(msg.Body), logger.FieldError, err)
+			continue
+		}
+		s.broker.publish(event)
+	}
+}
+
+// handleEventStream godoc
+// @Summary Stream events
+// @Description Server-Sent Events of the current user, anonymous clients get traffic events. Stream ends before the server's write timeout, browsers reconnect and resume with Last-Event-ID.
+// @Tags notifications
+// @Produce text/event-stream
+// @Param Last-Event-ID header string false "ID of the last received event"
+// @Param last_event_id query string false "Same as Last-Event-ID header"
+// @Success 200
+// @Failure 400 {object} utils.ErrorResponse
+// @Failure 500 {object} utils.ErrorResponse
+// @Failure 503 {object} utils.ErrorResponse
+// @Router /api/v1/events/stream [get]
+func (s *Server) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.WriteJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	ip := utils.ClientIP(r)
+	if !s.streams.acquire(ip) {
+		utils.WriteJSONError(w, http.StatusServiceUnavailable, "too many connections")
+		return
+	}
+	defer s.streams.release(ip)
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var after primitive.ObjectID
+	if lastID != "" {
+		var err error
+		after, err = primitive.ObjectIDFromHex(lastID)
+		if err != nil {
+			utils.WriteJSONError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+	}
+	log := logger.FromContext(r.Context())
+	u := auth.UserFromContext(r.Context())
+
+	// Subscribe before reading missed events so none are lost in between
+	client := s.broker.subscribe(u)
+	defer s.broker.unsubscribe(client)
+
+	var missed []events.Event
+	if !after.IsZero() {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		var err error
+		missed, err = notification.StoreGetAfter(ctx, u, after, streamReplayLimit)
+		cancel()
+		if err != nil {
+			log.Error("getting missed events failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not resume stream")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Nginx would buffer the stream otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+
+	sent := make(map[primitive.ObjectID]bool, len(missed))
+	for _, event := range missed {
+		if err := writeStreamEvent(w, event); err != nil {
+			return
+		}
+		sent[event.ID] = true
+	}
+	flusher.Flush()
+	// Client continues from the last one when it reconnects
+	if len(missed) == streamReplayLimit {
+		return
+	}
+
+	// Writes fail after the server's write timeout, so stream ends before it
+	deadline := time.NewTimer(s.HTTP.WriteTimeout - 5*time.Second)
+	defer deadline.Stop()
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			if sent[event.ID] {
+				continue
+			}
+			if err := writeStreamEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-deadline.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes event as notification JSON with event ID and type
+func writeStreamEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(notification.FromEvent(event))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID.Hex(), event.Type, data)
+	return err
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/events"
+	"miikka.xyz/devops-app/lib/user"
+)
+
+func TestBroker(t *testing.T) {
+	b := &broker{}
+	viewer := &user.User{ID: primitive.NewObjectID(), Role: user.RoleViewer}
+	maintainer := &user.User{ID: primitive.NewObjectID(), Role: user.RoleMaintainer}
+	anonymous := b.subscribe(nil)
+	viewerClient := b.subscribe(viewer)
+	maintainerClient := b.subscribe(maintainer)
+
+	b.publish(events.Event{ID: primitive.NewObjectID(), Type: consts.EventTrafficSpike})
+	b.publish(events.Event{ID: primitive.NewObjectID(), Type: consts.EventJobFailed})
+	// Completed jobs are streamed to anonymous clients but not notified to viewers
+	b.publish(events.Event{ID: primitive.NewObjectID(), Type: consts.EventJobCompleted})
+	created := user.CreatedEvent(viewer, "")
+	created.ID = primitive.NewObjectID()
+	b.publish(created)
+	for _, item := range []struct {
+		client *streamClient
+		count  int
+	}{{anonymous, 2}, {viewerClient, 2}, {maintainerClient, 3}} {
+		if len(item.client.events) != item.count {
+			t.Error("expected", item.count, "events, got", len(item.client.events))
+		}
+	}
+
+	// Client that falls behind is dropped
+	for i := 0; i < streamBuffer; i++ {
+		b.publish(events.Event{ID: primitive.NewObjectID(), Type: consts.EventTrafficSpike})
+	}
+	if _, found := b.clients[anonymous]; found {
+		t.Error("full client should be dropped")
+	}
+	b.unsubscribe(anonymous)
+
+	b.close()
+	if c := b.subscribe(viewer); c == nil {
+		t.Error("subscribing after close should return closed client")
+	} else if _, ok := <-c.events; ok {
+		t.Error("events of closed broker should be closed")
+	}
+	b.unsubscribe(viewerClient)
+}
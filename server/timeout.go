@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+type connContextKey struct{}
+
+// saveConn keeps connection in request context, so handlers that stream for
+// long can move its write deadline
+func saveConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// withWriteTimeout gives slow responses like exports own write deadline.
+// WriteTimeout of the server would cut the body off without an error to the
+// client. Server sets the deadline again for the next request of the connection.
+func withWriteTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
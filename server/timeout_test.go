@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportWriteTimeout(t *testing.T) {
+	const rows = 5000
+	// Streams a big export slower than WriteTimeout of the server
+	export := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < rows; i++ {
+			fmt.Fprintf(w, "repo-%d,2021-11-01,10,5,2,1\n", i)
+			if i%500 == 0 {
+				w.(http.Flusher).Flush()
+				time.Sleep(time.Millisecond * 30)
+			}
+		}
+	})
+	get := func(handler http.Handler) (int, error) {
+		srv := httptest.NewUnstartedServer(handler)
+		srv.Config.WriteTimeout = time.Millisecond * 100
+		srv.Config.ConnContext = saveConn
+		srv.Start()
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL)
+		if err != nil {
+			return 0, err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return strings.Count(string(body), "\n"), err
+	}
+
+	if count, err := get(export); err == nil && count == rows {
+		t.Error("export should be cut off without own deadline")
+	}
+	count, err := get(withWriteTimeout(time.Second*5, export))
+	if err != nil || count != rows {
+		t.Error("expected", rows, "rows, got", count, err)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"miikka.xyz/devops-app/lib/auth"
+	"miikka.xyz/devops-app/lib/token"
+	"miikka.xyz/devops-app/lib/user"
+	"miikka.xyz/devops-app/logger"
+	"miikka.xyz/devops-app/utils"
+)
+
+// authenticateToken puts user and token of 'Authorization: Bearer dvp_...' to
+// request context. Other bearer tokens, like ADMIN_TOKEN, are left for require.
+func (s *Server) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(value, token.Prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := logger.FromContext(r.Context())
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+		defer cancel()
+		t, err := token.StoreGetTokenByHash(ctx, token.Hash(value))
+		if err != nil {
+			log.Error("getting token failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not check token")
+			return
+		}
+		now := time.Now()
+		if t == nil || !t.IsValid(now) {
+			log.Warn("invalid api token", "path", r.URL.Path)
+			invalidToken(w)
+			return
+		}
+		u, err := user.StoreGetUserByID(ctx, t.UserID)
+		if err != nil {
+			log.Error("getting token user failed", logger.FieldError, err)
+			utils.WriteJSONError(w, http.StatusInternalServerError, "could not check token")
+			return
+		}
+		if u == nil || !u.IsActive {
+			log.Warn("api token of inactive user", "token_id", t.ID.Hex())
+			invalidToken(w)
+			return
+		}
+
+		// Last use is not worth slowing down the request
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			if err := token.StoreTouchToken(ctx, t.ID, now); err != nil {
+				log.Warn("updating token last use failed", logger.FieldError, err)
+			}
+		}()
+
+		reqCtx := token.NewContext(auth.NewContext(r.Context(), u), t)
+		reqCtx = logger.NewContext(reqCtx, log.With("user", u.Username, "token_id", t.ID.Hex()))
+		next.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+func invalidToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	utils.WriteJSONError(w, http.StatusUnauthorized, "invalid or expired token")
+}
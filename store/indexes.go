@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miikka.xyz/devops-app/consts"
+)
+
+// indexes by collection. Unique indexes make concurrent inserts of the same
+// value fail with a duplicate key error instead of creating duplicates.
+var indexes = map[string][]mongo.IndexModel{
+	consts.CollectionEvents: {
+		// Events with a key, like daily summaries, are stored only once
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		// Unread notifications are matched by type or by the user as object
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "object_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	consts.CollectionRepoTraffic: {
+		// Exports sort by repository and time
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "timestamp", Value: 1}}},
+	},
+	consts.CollectionUsers: {
+		// Usernames of deleted users stay taken
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	consts.CollectionAPITokens: {
+		// Every request with a token looks it up by hash
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	consts.CollectionAuditLog: {
+		// Entries are filtered by actor or action and listed newest first
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	},
+	consts.CollectionDeliveries: {
+		// Stale pending deliveries are claimed by status and update time
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	},
+	consts.CollectionJobRuns: {
+		// Redelivered job requests update the same run
+		{Keys: bson.D{{Key: "run_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+}
+
+// EnsureIndexes creates missing indexes, existing ones are left as they are
+func EnsureIndexes(ctx context.Context) error {
+	db := client.Database(consts.DatabaseName)
+	for coll, models := range indexes {
+		if _, err := db.Collection(coll).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("creating indexes of %s: %v", coll, err)
+		}
+	}
+	return nil
+}
@@ -1,9 +1,22 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"miikka.xyz/devops-app/consts"
+	"miikka.xyz/devops-app/logger"
 )
 
 func GetEnv(envName string, valueDefault string) string {
@@ -14,6 +27,15 @@ func GetEnv(envName string, valueDefault string) string {
 	return value
 }
 
+// GetEnvDuration parses env variable like '30s'. Default is used when variable is missing or invalid.
+func GetEnvDuration(envName string, valueDefault time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(envName))
+	if err != nil || value <= 0 {
+		return valueDefault
+	}
+	return value
+}
+
 func OnlyAlphaNumberOrUnderscore(s string) bool {
 	for _, r := range s {
 		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
@@ -26,3 +48,192 @@ func OnlyAlphaNumberOrUnderscore(s string) bool {
 func DateToEuropean(t time.Time) string {
 	return strings.Replace(t.Format("02-01-2006"), "-", ".", -1)
 }
+
+// ErrorResponse is a JSON body of failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// WriteJSON writes value as a JSON response with status code
+func WriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Error("writing JSON response failed", logger.FieldError, err)
+	}
+}
+
+// WriteJSONError writes message as a JSON error response with status code
+func WriteJSONError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, ErrorResponse{Error: message})
+}
+
+// ReadJSON reads request body to v. Error response is written if reading fails.
+func ReadJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	log := logger.FromContext(r.Context())
+	bytes, err := ioutil.ReadAll(io.LimitReader(r.Body, consts.MaxBodySizeBytes))
+	if err != nil {
+		log.Error("reading body failed", logger.FieldError, err)
+		WriteJSONError(w, http.StatusInternalServerError, consts.ErrBody)
+		return false
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		log.Warn("invalid JSON", logger.FieldError, err)
+		WriteJSONError(w, http.StatusBadRequest, consts.ErrJSON)
+		return false
+	}
+	return true
+}
+
+// Pagination is parsed from 'page' and 'per_page' query parameters
+type Pagination struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// Pagination defaults
+const (
+	DefaultPerPage = 30
+	MaxPerPage     = 100
+)
+
+// ParsePagination reads 'page' and 'per_page' query parameters. Page starts from 1.
+func ParsePagination(query url.Values) (Pagination, error) {
+	p := Pagination{Page: 1, PerPage: DefaultPerPage}
+	if value := query.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return p, errors.New("invalid 'page'")
+		}
+		p.Page = page
+	}
+	if value := query.Get("per_page"); value != "" {
+		perPage, err := strconv.Atoi(value)
+		if err != nil || perPage < 1 || perPage > MaxPerPage {
+			return p, fmt.Errorf("invalid 'per_page', must be between 1 and %d", MaxPerPage)
+		}
+		p.PerPage = perPage
+	}
+	return p, nil
+}
+
+// Bounds returns slice bounds of current page for 'total' items and sets total
+func (p *Pagination) Bounds(total int) (int, int) {
+	p.Total = total
+	from := (p.Page - 1) * p.PerPage
+	if from > total {
+		from = total
+	}
+	to := from + p.PerPage
+	if to > total {
+		to = total
+	}
+	return from, to
+}
+
+// ParseSort reads 'sort' query parameter. Leading '-' means descending order.
+// Field must be one of the allowed ones, otherwise error is returned.
+func ParseSort(query url.Values, defaultField string, allowed ...string) (string, bool, error) {
+	value := strings.TrimSpace(query.Get("sort"))
+	if value == "" {
+		value = defaultField
+	}
+	desc := strings.HasPrefix(value, "-")
+	field := strings.TrimPrefix(value, "-")
+	for _, a := range allowed {
+		if a == field {
+			return field, desc, nil
+		}
+	}
+	return "", false, fmt.Errorf("invalid 'sort', allowed fields: %s", strings.Join(allowed, ", "))
+}
+
+// RedactURL hides password of the URL so it can be logged
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid url"
+	}
+	return u.Redacted()
+}
+
+var (
+	trustedOnce    sync.Once
+	trustedProxies []*net.IPNet
+)
+
+// ClientIP returns IP of the client that made the request. X-Forwarded-For and
+// X-Real-IP are read only from proxies listed in TRUSTED_PROXIES, anyone else
+// could set them.
+func ClientIP(r *http.Request) string {
+	trustedOnce.Do(func() {
+		trustedProxies = ParseTrustedProxies(GetEnv("TRUSTED_PROXIES", ""))
+	})
+	return clientIP(r, trustedProxies)
+}
+
+// ParseTrustedProxies parses comma separated CIDRs or IPs. Invalid ones are skipped.
+func ParseTrustedProxies(value string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0)
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			logger.Warn("invalid TRUSTED_PROXIES entry, skipping", "value", s)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+	// Proxies append the address they got the request from, so the client is
+	// the right-most address that is not one of our proxies
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+		if !isTrusted(addr, trusted) {
+			return ip
+		}
+	}
+	// Without X-Forwarded-For, or when every address in it is a proxy
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1, invalid")
+	if len(trusted) != 2 {
+		t.Fatal("invalid entries should be skipped", trusted)
+	}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"[::1]:52000", "", "", "::1"},
+		// Headers of untrusted clients are ignored
+		{"203.0.113.5:1000", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"10.0.0.2:1000", "198.51.100.1", "", "198.51.100.1"},
+		// Client can't hide behind an address it prepends itself
+		{"10.0.0.2:1000", "1.2.3.4, 198.51.100.1, 192.168.1.1", "", "198.51.100.1"},
+		{"10.0.0.2:1000", "", "198.51.100.2", "198.51.100.2"},
+		{"10.0.0.2:1000", "", "", "10.0.0.2"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+		if ip := clientIP(req, trusted); ip != test.want {
+			t.Errorf("%s %q: got %s, want %s", test.remote, test.forwarded, ip, test.want)
+		}
+	}
+}